@@ -0,0 +1,83 @@
+// Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/apex/log"
+	mcdb "github.com/materials-commons/gomcdb"
+	"github.com/materials-commons/mcbridgefs/pkg/fs/mcbridgefs"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fsckProjectID     int
+	fsckRepair        bool
+	fsckSkipChecksums bool
+	fsckCheckOrphans  bool
+	fsckRemoveOrphans bool
+)
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+	fsckCmd.Flags().IntVar(&fsckProjectID, "project", -1, "Project to check")
+	fsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "Repair the problems found, without it the report is a dry run of the repairs")
+	fsckCmd.Flags().BoolVar(&fsckCheckOrphans, "check-orphans", false, "Also report files in the storage that don't belong to any file. This walks the whole storage, which is shared by all projects")
+	fsckCmd.Flags().BoolVar(&fsckRemoveOrphans, "remove-orphans", false, "Check for orphans like --check-orphans, and with --repair remove them. This covers the whole storage, not just the project")
+	fsckCmd.Flags().BoolVar(&fsckSkipChecksums, "skip-checksums", false, "Only check sizes rather than reading every file to check its checksum")
+}
+
+// fsckCmd checks the files for a project against the underlying storage
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check a project's files against the underlying storage",
+	Long: `fsck walks the files in a project and checks each against its file in the underlying storage, reporting
+missing files, size and checksum mismatches, and versions left behind by aborted transfers. The report is written
+as JSON to stdout. Without --repair nothing is changed, and the report shows the repairs that would be made.
+
+The underlying storage is shared by all projects, so files in it that don't belong to any file can't be attributed
+to a project. They are only looked for when --check-orphans or --remove-orphans is given, which walks the whole
+storage rather than just the project, and are only removed with --remove-orphans and --repair. fsck exits with a
+non-zero status when there are unrepaired problems.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if fsckProjectID == -1 {
+			log.Fatalf("No project specified.")
+		}
+
+		db := mcdb.MustConnectToDB()
+
+		checker := mcbridgefs.NewFsck(db, mcfsDir, fsckProjectID)
+		checker.VerifyChecksums = !fsckSkipChecksums
+		checker.CheckOrphans = fsckCheckOrphans
+		checker.RemoveOrphans = fsckRemoveOrphans
+
+		report, err := checker.Run(fsckRepair)
+		if err != nil {
+			log.Errorf("fsck of project %d failed: %s", fsckProjectID, err)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			log.Fatalf("Unable to write report: %s", err)
+		}
+
+		if err != nil || report.Unrepaired() != 0 {
+			os.Exit(1)
+		}
+	},
+}
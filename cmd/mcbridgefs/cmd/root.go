@@ -18,6 +18,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -86,6 +87,18 @@ file versions and consistency for the project that the transfer request is assoc
 		ctx, cancel := context.WithCancel(context.Background())
 
 		rootNode := mcbridgefs.CreateFS(mcfsDir, db, transferRequest)
+
+		// Finish the releases that an earlier run of the bridge for this transfer request didn't
+		// complete. This happens first so that the recovered versions aren't resumed or removed
+		// as interrupted uploads.
+		if err := mcbridgefs.RecoverReleases(); err != nil {
+			log.Fatalf("Unable to use the upload state directory: %s", err)
+		}
+
+		// Uploads interrupted by an earlier run of the bridge for this transfer request are resumed
+		// rather than started over.
+		mcbridgefs.StartUploadResumer(ctx)
+
 		server := mustStartFuseFileServer(args[0], rootNode)
 
 		onClose := func() {
@@ -98,10 +111,23 @@ file versions and consistency for the project that the transfer request is assoc
 		activityMonitor := monitor.NewActivityMonitor(db, transferRequest)
 		activityMonitor.Start(ctx)
 
+		// Poll for changes made to the project outside the mount. MC_CHANGE_POLL_INTERVAL is a duration
+		// such as "10s". Setting it to "0" turns off polling.
+		changePollInterval, err := time.ParseDuration(os.Getenv("MC_CHANGE_POLL_INTERVAL"))
+		if err != nil {
+			changePollInterval = 10 * time.Second
+		}
+
+		changeWatcher := mcbridgefs.NewChangeWatcher(rootNode, changePollInterval)
+		changeWatcher.Start(ctx)
+
 		go server.listenForUnmount(cancel)
 
 		log.Infof("Mounted project at %q, use ctrl+c to stop", args[0])
 		server.Wait()
+
+		// The mount was unmounted outside of the bridge, eg with fusermount
+		server.shutdown(cancel)
 	},
 }
 
@@ -109,8 +135,9 @@ var timeout = 10 * time.Second
 
 type Server struct {
 	*fuse.Server
-	mountPoint string
-	c          chan os.Signal
+	mountPoint   string
+	c            chan os.Signal
+	shutdownOnce sync.Once
 }
 
 func mustStartFuseFileServer(mountPoint string, root *mcbridgefs.Node) *Server {
@@ -140,13 +167,33 @@ func (s *Server) listenForUnmount(cancelFunc context.CancelFunc) {
 	sig := <-s.c
 	log.Infof("Got %s signal, unmounting %q...", sig, s.mountPoint)
 	cancelFunc()
+
 	if err := s.Unmount(); err != nil {
 		log.Errorf("Failed to unmount: %s, try '/usr/bin/fusermount -u %s' manually.", err, s.mountPoint)
 	}
 
+	s.shutdown(cancelFunc)
 	os.Exit(0)
 }
 
+// shutdown finishes up once the bridge is stopping, however it was stopped. It's safe to call more
+// than once, as only the first call does anything.
+func (s *Server) shutdown(cancelFunc context.CancelFunc) {
+	s.shutdownOnce.Do(func() {
+		cancelFunc()
+
+		stats := mcbridgefs.GetPathCacheStats()
+		log.Infof("Path cache: %d hits, %d misses, %d entries", stats.Hits, stats.Misses, stats.Entries)
+
+		dedupStats := mcbridgefs.GetDedupStats()
+		log.Infof("Transfer request %d deduplicated %d files, saving %d bytes", dedupStats.TransferRequestID, dedupStats.Files, dedupStats.BytesSaved)
+
+		// Versions released within the reopen grace period are finalized now, rather than waiting on
+		// the recovery pass the next time a bridge starts for the transfer request.
+		mcbridgefs.FinalizePendingReleases()
+	})
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 
 	"github.com/apex/log"
@@ -120,6 +121,50 @@ type StartBridgeRequest struct {
 	TransferRequestID int    `json:"transfer_request_id"`
 	MountPath         string `json:"mount_path"`
 	LogPath           string `json:"log_path"`
+
+	// AllowDeleteExisting allows the bridge to delete files that existed before the transfer request
+	AllowDeleteExisting bool `json:"allow_delete_existing"`
+
+	// RecursiveRmdir allows the bridge to remove non-empty directories created during the transfer request
+	RecursiveRmdir bool `json:"recursive_rmdir"`
+
+	// ChecksumAlgorithms are the checksums (md5, sha1, sha256, xxhash64) the bridge computes. The first is stored as the file checksum
+	ChecksumAlgorithms []string `json:"checksum_algorithms"`
+
+	// FileModeMask is an octal mask, eg "0755", limiting the permissions that can be set on files through chmod
+	FileModeMask string `json:"file_mode_mask"`
+
+	// ReopenPolicy is "new-version" (the default) or "continue-version", and decides if reopening a file for write after it was closed creates another version
+	ReopenPolicy string `json:"reopen_policy"`
+
+	// ReopenGrace is a duration, eg "5s", for how long a closed file can be reopened to continue its version when ReopenPolicy is "continue-version"
+	ReopenGrace string `json:"reopen_grace"`
+
+	// SymlinkPolicy is "store" (the default) to keep symlinks as links, or "dereference" to store the file each link points at in its place
+	SymlinkPolicy string `json:"symlink_policy"`
+
+	// ChangePollInterval is a duration, eg "10s", for how often the bridge polls for changes made outside the mount. "0" turns polling off
+	ChangePollInterval string `json:"change_poll_interval"`
+}
+
+// bridgeEnv returns the environment for a bridge. The bridge policy settings for the transfer
+// request are passed to the bridge as MC_BRIDGE_* environment variables. The change poll interval
+// is only passed when it's set, so that otherwise the bridge uses the daemon's setting.
+func bridgeEnv(req StartBridgeRequest) []string {
+	env := append(os.Environ(),
+		fmt.Sprintf("MC_BRIDGE_ALLOW_DELETE_EXISTING=%t", req.AllowDeleteExisting),
+		fmt.Sprintf("MC_BRIDGE_RECURSIVE_RMDIR=%t", req.RecursiveRmdir),
+		fmt.Sprintf("MC_BRIDGE_CHECKSUMS=%s", strings.Join(req.ChecksumAlgorithms, ",")),
+		fmt.Sprintf("MC_BRIDGE_FILE_MODE_MASK=%s", req.FileModeMask),
+		fmt.Sprintf("MC_BRIDGE_REOPEN_POLICY=%s", req.ReopenPolicy),
+		fmt.Sprintf("MC_BRIDGE_REOPEN_GRACE=%s", req.ReopenGrace),
+		fmt.Sprintf("MC_BRIDGE_SYMLINK_POLICY=%s", req.SymlinkPolicy))
+
+	if req.ChangePollInterval != "" {
+		env = append(env, fmt.Sprintf("MC_CHANGE_POLL_INTERVAL=%s", req.ChangePollInterval))
+	}
+
+	return env
 }
 
 func startBridgeController(c echo.Context) error {
@@ -139,6 +184,7 @@ func startBridge(req StartBridgeRequest) {
 
 	cmd := exec.Command("nohup", "/usr/local/bin/mcbridgefs.sh", fmt.Sprintf("%d", req.TransferRequestID),
 		req.MountPath, req.LogPath)
+	cmd.Env = bridgeEnv(req)
 	if err := cmd.Start(); err != nil {
 		log.Errorf("Starting bridge failed (%d, %s): %s", req.TransferRequestID, req.MountPath, err)
 		return
@@ -4,8 +4,9 @@ go 1.15
 
 require (
 	github.com/apex/log v1.9.0
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/go-resty/resty/v2 v2.5.0
-	github.com/gosimple/slug v1.12.0 // indirect
+	github.com/gosimple/slug v1.12.0
 	github.com/hanwen/go-fuse/v2 v2.0.3
 	github.com/hashicorp/go-uuid v1.0.2
 	github.com/jinzhu/now v1.1.5 // indirect
@@ -0,0 +1,50 @@
+package mcbridgefs
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// AttrCache caches the attributes of files and directories keyed by inode number, so that a stat
+// doesn't need to query the database each time. Entries expire after the TTL, which bounds how
+// long changes made outside of this bridge take to show up. Changes made through the bridge
+// invalidate the affected entries.
+//
+// The cache holds at most size entries, evicting the least recently used entries once it's full.
+type AttrCache struct {
+	cache *lruCache
+}
+
+// NewAttrCache creates a new AttrCache holding up to size entries, which are valid for ttl. A size
+// or ttl of zero turns off caching.
+func NewAttrCache(size int, ttl time.Duration) *AttrCache {
+	if ttl <= 0 {
+		size = 0
+	}
+
+	return &AttrCache{cache: newLRUCache(size, ttl)}
+}
+
+// Get returns the cached attributes for the inode ino. ok is false when there aren't any, or they
+// have expired.
+func (c *AttrCache) Get(ino uint64) (attr fuse.Attr, ok bool) {
+	value, ok := c.cache.get(ino)
+	if !ok {
+		return attr, false
+	}
+
+	return value.(fuse.Attr), true
+}
+
+// Store caches the attributes for the inode ino.
+func (c *AttrCache) Store(ino uint64, attr fuse.Attr) {
+	c.cache.store(ino, attr)
+}
+
+// Invalidate removes the cached attributes for the given inodes.
+func (c *AttrCache) Invalidate(inos ...uint64) {
+	for _, ino := range inos {
+		c.cache.remove(ino)
+	}
+}
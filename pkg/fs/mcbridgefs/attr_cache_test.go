@@ -0,0 +1,33 @@
+package mcbridgefs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttrCacheGetStore(t *testing.T) {
+	c := NewAttrCache(10, time.Minute)
+
+	_, ok := c.Get(2)
+	require.False(t, ok, "Empty cache should not have entry")
+
+	c.Store(2, fuse.Attr{Ino: 2, Size: 10})
+	attr, ok := c.Get(2)
+	require.True(t, ok, "Entry should be cached")
+	require.Equal(t, uint64(10), attr.Size)
+
+	c.Invalidate(2)
+	_, ok = c.Get(2)
+	require.False(t, ok, "Invalidated entry should not be returned")
+}
+
+func TestAttrCacheDisabled(t *testing.T) {
+	c := NewAttrCache(10, 0)
+	c.Store(2, fuse.Attr{Ino: 2})
+
+	_, ok := c.Get(2)
+	require.False(t, ok, "A zero TTL should turn off caching")
+}
@@ -0,0 +1,296 @@
+package mcbridgefs
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gosimple/slug"
+	"github.com/hashicorp/go-uuid"
+	"gorm.io/gorm"
+)
+
+// fileModelType is the polymorphic type Materials Commons uses for files in the attributes
+// and taggables tables.
+const fileModelType = "App\\Models\\File"
+
+// attribute is a Materials Commons attribute attached to a file. Only the columns the bridge
+// uses are mapped.
+type attribute struct {
+	ID               int
+	UUID             string
+	Name             string
+	AttributableType string
+	AttributableID   int
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+func (attribute) TableName() string {
+	return "attributes"
+}
+
+// attributeValue is the value of an attribute. Val is JSON of the form {"value": <value>}.
+type attributeValue struct {
+	ID          int
+	UUID        string
+	AttributeID int
+	Val         string
+	Unit        string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (attributeValue) TableName() string {
+	return "attribute_values"
+}
+
+// tag is a Materials Commons tag. Name and Slug are JSON keyed by locale.
+type tag struct {
+	ID          int
+	Name        string
+	Slug        string
+	OrderColumn int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (tag) TableName() string {
+	return "tags"
+}
+
+type taggable struct {
+	TagID        int
+	TaggableType string
+	TaggableID   int
+}
+
+func (taggable) TableName() string {
+	return "taggables"
+}
+
+// errAttributeExists and errAttributeNotFound are returned by setFileAttribute when the
+// create or replace semantics requested by setxattr can't be met.
+var (
+	errAttributeExists   = errors.New("attribute exists")
+	errAttributeNotFound = errors.New("attribute not found")
+)
+
+// getFileAttributes returns the attributes for a file and their values. If an attribute has
+// several values then the last one is returned.
+func getFileAttributes(fileID int) (map[string]string, error) {
+	var rows []struct {
+		Name string
+		Val  string
+	}
+
+	err := db.Table("attributes").
+		Select("attributes.name, attribute_values.val").
+		Joins("join attribute_values on attribute_values.attribute_id = attributes.id").
+		Where("attributes.attributable_type = ?", fileModelType).
+		Where("attributes.attributable_id = ?", fileID).
+		Order("attribute_values.id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string, len(rows))
+	for _, row := range rows {
+		attrs[row.Name] = decodeAttributeValue(row.Val)
+	}
+
+	return attrs, nil
+}
+
+// setFileAttribute creates or updates the attribute name on a file. mustCreate and mustReplace
+// correspond to the XATTR_CREATE and XATTR_REPLACE flags.
+func setFileAttribute(tx *gorm.DB, fileID int, name, value string, mustCreate, mustReplace bool) error {
+	encoded, err := encodeAttributeValue(value)
+	if err != nil {
+		return err
+	}
+
+	var attr attribute
+	err = tx.Where("attributable_type = ?", fileModelType).
+		Where("attributable_id = ?", fileID).
+		Where("name = ?", name).
+		First(&attr).Error
+
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	case err == nil && mustCreate:
+		return errAttributeExists
+	case err != nil && mustReplace:
+		return errAttributeNotFound
+	case err != nil:
+		if attr.UUID, err = uuid.GenerateUUID(); err != nil {
+			return err
+		}
+		attr.Name = name
+		attr.AttributableType = fileModelType
+		attr.AttributableID = fileID
+		if err := tx.Create(&attr).Error; err != nil {
+			return err
+		}
+	}
+
+	val := attributeValue{AttributeID: attr.ID, Val: encoded}
+	if val.UUID, err = uuid.GenerateUUID(); err != nil {
+		return err
+	}
+
+	// An attribute set through the mount only has a single value, which replaces any existing ones.
+	if err := tx.Where("attribute_id = ?", attr.ID).Delete(&attributeValue{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Create(&val).Error
+}
+
+// deleteFileAttribute deletes the attribute name, and its values, from a file.
+func deleteFileAttribute(tx *gorm.DB, fileID int, name string) error {
+	var attr attribute
+	err := tx.Where("attributable_type = ?", fileModelType).
+		Where("attributable_id = ?", fileID).
+		Where("name = ?", name).
+		First(&attr).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return errAttributeNotFound
+	case err != nil:
+		return err
+	}
+
+	if err := tx.Where("attribute_id = ?", attr.ID).Delete(&attributeValue{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Delete(&attr).Error
+}
+
+// getFileTags returns the names of the tags on a file.
+func getFileTags(fileID int) ([]string, error) {
+	var names []string
+	err := db.Table("tags").
+		Joins("join taggables on taggables.tag_id = tags.id").
+		Where("taggables.taggable_type = ?", fileModelType).
+		Where("taggables.taggable_id = ?", fileID).
+		Order("tags.id").
+		Pluck("JSON_UNQUOTE(JSON_EXTRACT(tags.name, '$.en'))", &names).Error
+	return names, err
+}
+
+// addFileTag adds the tag name to a file, creating the tag if it doesn't exist.
+func addFileTag(tx *gorm.DB, fileID int, name string) error {
+	t, err := findTag(tx, name)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		t = &tag{Name: localizedJSON(name), Slug: localizedJSON(slug.Make(name))}
+		if err := tx.Create(t).Error; err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+
+	var count int64
+	err = tx.Model(&taggable{}).
+		Where("tag_id = ?", t.ID).
+		Where("taggable_type = ?", fileModelType).
+		Where("taggable_id = ?", fileID).
+		Count(&count).Error
+	if err != nil || count != 0 {
+		return err
+	}
+
+	return tx.Create(&taggable{TagID: t.ID, TaggableType: fileModelType, TaggableID: fileID}).Error
+}
+
+// removeFileTag removes the tag name from a file. The tag itself is left in place because other
+// entries may use it.
+func removeFileTag(tx *gorm.DB, fileID int, name string) error {
+	t, err := findTag(tx, name)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return errAttributeNotFound
+	case err != nil:
+		return err
+	}
+
+	result := tx.Where("tag_id = ?", t.ID).
+		Where("taggable_type = ?", fileModelType).
+		Where("taggable_id = ?", fileID).
+		Delete(&taggable{})
+	switch {
+	case result.Error != nil:
+		return result.Error
+	case result.RowsAffected == 0:
+		return errAttributeNotFound
+	default:
+		return nil
+	}
+}
+
+func findTag(tx *gorm.DB, name string) (*tag, error) {
+	var t tag
+	if err := tx.Where("JSON_UNQUOTE(JSON_EXTRACT(name, '$.en')) = ?", name).First(&t).Error; err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// jsonNumberRegex matches the JSON syntax for a number.
+var jsonNumberRegex = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// encodeAttributeValue encodes a value the way Materials Commons stores it. Values that are JSON
+// numbers are stored as numbers, as long as they read back unchanged, everything else as a string.
+// So "300.5" is stored as a number, but "007", "1e3" and "NaN" are stored as strings.
+func encodeAttributeValue(value string) (string, error) {
+	var v interface{} = value
+	if jsonNumberRegex.MatchString(value) {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			if b, err := json.Marshal(f); err == nil && string(b) == value {
+				v = f
+			}
+		}
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"value": v})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// decodeAttributeValue returns the value from an attribute_values val column.
+func decodeAttributeValue(val string) string {
+	var v struct {
+		Value interface{} `json:"value"`
+	}
+
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		return val
+	}
+
+	switch value := v.Value.(type) {
+	case string:
+		return value
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
+
+// localizedJSON returns the JSON used for translatable tag columns.
+func localizedJSON(value string) string {
+	b, _ := json.Marshal(map[string]string{"en": value})
+	return string(b)
+}
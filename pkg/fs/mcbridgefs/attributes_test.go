@@ -0,0 +1,48 @@
+package mcbridgefs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributeValueRoundTrip(t *testing.T) {
+	encode := func(value string) string {
+		encoded, err := encodeAttributeValue(value)
+		require.NoError(t, err)
+		return encoded
+	}
+
+	require.Equal(t, `{"value":"hot"}`, encode("hot"))
+	require.Equal(t, `{"value":300.5}`, encode("300.5"))
+	require.Equal(t, `{"value":-2}`, encode("-2"))
+
+	// Only JSON numbers that read back unchanged are stored as numbers
+	for _, value := range []string{"NaN", "Inf", "-Inf", "0x1p4", "1_000", "007", "1e3", "300.50", "+1", ".5", ""} {
+		require.Equal(t, `{"value":"`+value+`"}`, encode(value), "%q should be stored as a string", value)
+		require.Equal(t, value, decodeAttributeValue(encode(value)))
+	}
+
+	require.Equal(t, "hot", decodeAttributeValue(encode("hot")))
+	require.Equal(t, "300.5", decodeAttributeValue(encode("300.5")))
+	require.Equal(t, "[1,2]", decodeAttributeValue(`{"value":[1,2]}`))
+	require.Equal(t, "not json", decodeAttributeValue("not json"))
+}
+
+func TestWritableXattrName(t *testing.T) {
+	name, isTag, errno := writableXattrName("user.mc.attr.temperature")
+	require.Equal(t, "temperature", name)
+	require.False(t, isTag)
+	require.Zero(t, errno)
+
+	name, isTag, errno = writableXattrName("user.mc.tag.calibrated")
+	require.Equal(t, "calibrated", name)
+	require.True(t, isTag)
+	require.Zero(t, errno)
+
+	_, _, errno = writableXattrName("user.mc.uuid")
+	require.NotZero(t, errno)
+
+	_, _, errno = writableXattrName("user.other")
+	require.NotZero(t, errno)
+}
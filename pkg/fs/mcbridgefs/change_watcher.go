@@ -0,0 +1,260 @@
+package mcbridgefs
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// ChangeWatcher keeps the mount coherent with changes made to the project outside of it, such as
+// files uploaded through the web UI or by another bridge. It polls for files and directories in
+// the project that changed since the last poll, drops them from the bridge's caches, and tells
+// the kernel to invalidate the entries, attributes and contents it has cached for them.
+//
+// Changes are found by their updated_at time. The watermark is the latest updated_at time seen.
+// A change can be committed after changes with a later updated_at time were already seen, so each
+// poll scans again from one interval before the watermark, and skips the changes it has already
+// handled.
+type ChangeWatcher struct {
+	root     *Node
+	interval time.Duration
+
+	watermark time.Time
+
+	// seen holds the changes handled that are still inside the window scanned again by each poll.
+	seen map[changeKey]bool
+}
+
+// changeKey identifies a single change to an entry.
+type changeKey struct {
+	id        int
+	updatedAt time.Time
+}
+
+// fileChange holds the columns the ChangeWatcher needs for a changed entry.
+type fileChange struct {
+	ID          int
+	DirectoryID int
+	Name        string
+	Path        string
+	MimeType    string
+	UpdatedAt   time.Time
+}
+
+// changeWatcherPageSize is the most changes read in a single query.
+const changeWatcherPageSize = 1000
+
+// NewChangeWatcher creates a ChangeWatcher for the mount whose root is root. The project is polled
+// every interval.
+func NewChangeWatcher(root *Node, interval time.Duration) *ChangeWatcher {
+	return &ChangeWatcher{root: root, interval: interval, seen: make(map[changeKey]bool)}
+}
+
+// Start begins watching for changes. Changes made before Start is called are ignored. A watcher
+// with an interval of zero doesn't do anything.
+func (w *ChangeWatcher) Start(ctx context.Context) {
+	if w.interval <= 0 {
+		return
+	}
+
+	var watermark sql.NullTime
+	err := db.Model(&mcmodel.File{}).
+		Select("MAX(updated_at)").
+		Where("project_id = ?", transferRequest.ProjectID).
+		Scan(&watermark).Error
+	if err != nil {
+		log.Errorf("Unable to start change watcher: %s", err)
+		return
+	}
+
+	w.watermark = watermark.Time
+
+	log.Info("Starting change watcher...")
+	go w.watchForChanges(ctx)
+}
+
+func (w *ChangeWatcher) watchForChanges(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infof("Shutting down change watcher")
+			return
+		case <-time.After(w.interval):
+		}
+
+		w.poll()
+	}
+}
+
+// poll processes all the changes since one interval before the watermark that haven't been
+// handled yet. Changes with the same updated_at time are paged through by id.
+func (w *ChangeWatcher) poll() {
+	since := w.watermark.Add(-w.interval)
+	cursor, lastID := since, 0
+
+	for {
+		var changes []fileChange
+		err := db.Model(&mcmodel.File{}).
+			Select("id, directory_id, name, path, mime_type, updated_at").
+			Where("project_id = ?", transferRequest.ProjectID).
+			Where("updated_at > ? OR (updated_at = ? AND id > ?)", cursor, cursor, lastID).
+			Order("updated_at, id").
+			Limit(changeWatcherPageSize).
+			Scan(&changes).Error
+		if err != nil {
+			// (Hopefully) transient error on database, try again on the next poll
+			log.Errorf("Change watcher failed querying for changes: %s", err)
+			return
+		}
+
+		if len(changes) == 0 {
+			break
+		}
+
+		var unseen []fileChange
+		for _, change := range changes {
+			if !w.seen[changeKey{id: change.ID, updatedAt: change.UpdatedAt}] {
+				unseen = append(unseen, change)
+			}
+		}
+
+		if err := w.invalidate(unseen); err != nil {
+			log.Errorf("Change watcher failed invalidating changes: %s", err)
+			return
+		}
+
+		for _, change := range unseen {
+			w.seen[changeKey{id: change.ID, updatedAt: change.UpdatedAt}] = true
+			if change.UpdatedAt.After(w.watermark) {
+				w.watermark = change.UpdatedAt
+			}
+		}
+
+		last := changes[len(changes)-1]
+		cursor, lastID = last.UpdatedAt, last.ID
+
+		if len(changes) < changeWatcherPageSize {
+			break
+		}
+	}
+
+	// Changes that have dropped out of the window won't be scanned again.
+	since = w.watermark.Add(-w.interval)
+	for key := range w.seen {
+		if !key.updatedAt.After(since) {
+			delete(w.seen, key)
+		}
+	}
+}
+
+// invalidate drops the changed entries from the caches. The paths of the directories that the
+// changed entries are in are looked up in a single query.
+func (w *ChangeWatcher) invalidate(changes []fileChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var dirIDs []int
+	for _, change := range changes {
+		dirIDs = append(dirIDs, change.DirectoryID)
+	}
+
+	var dirs []struct {
+		ID   int
+		Path string
+	}
+
+	if err := db.Model(&mcmodel.File{}).Select("id, path").Where("id in ?", dirIDs).Scan(&dirs).Error; err != nil {
+		return err
+	}
+
+	dirPaths := make(map[int]string, len(dirs))
+	for _, dir := range dirs {
+		dirPaths[dir.ID] = dir.Path
+	}
+
+	seen := make(map[string]bool)
+	for _, change := range changes {
+		isDir := change.MimeType == "directory"
+
+		var dirPath string
+		switch {
+		case isDir && change.Path == "/":
+			// The project root has no parent to invalidate it in
+			pathCache.Invalidate("/")
+			attrCache.Invalidate(w.root.StableAttr().Ino)
+			continue
+		case isDir:
+			dirPath = filepath.Dir(change.Path)
+		default:
+			var ok bool
+			if dirPath, ok = dirPaths[change.DirectoryID]; !ok {
+				continue
+			}
+		}
+
+		path := filepath.Join(dirPath, change.Name)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		w.invalidateEntry(dirPath, change.Name, isDir)
+	}
+
+	return nil
+}
+
+// invalidateEntry drops the entry name in the directory at dirPath from the bridge's caches and
+// the kernel's.
+func (w *ChangeWatcher) invalidateEntry(dirPath, name string, isDir bool) {
+	path := filepath.Join(dirPath, name)
+	pathCache.Invalidate(dirPath)
+	if isDir {
+		pathCache.InvalidateTree(path)
+	} else {
+		pathCache.Invalidate(path)
+	}
+
+	// When the kernel doesn't have the directory, it doesn't have anything cached for the entry.
+	parent := w.findInode(dirPath)
+	if parent == nil {
+		return
+	}
+
+	attrCache.Invalidate(parent.StableAttr().Ino)
+	if child := parent.GetChild(name); child != nil {
+		attrCache.Invalidate(child.StableAttr().Ino)
+		if !isDir {
+			// The file may have a new current version
+			_ = child.NotifyContent(0, 0)
+		}
+	}
+
+	_ = parent.NotifyEntry(name)
+
+	// The directory listing and attributes have changed
+	_ = parent.NotifyContent(0, 0)
+}
+
+// findInode returns the inode for the directory at dirPath, or nil when it isn't loaded.
+func (w *ChangeWatcher) findInode(dirPath string) *fs.Inode {
+	inode := w.root.EmbeddedInode()
+	for _, name := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		if inode = inode.GetChild(name); inode == nil {
+			return nil
+		}
+	}
+
+	return inode
+}
@@ -0,0 +1,168 @@
+package mcbridgefs
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// The checksum algorithms a bridge can compute.
+const (
+	checksumMD5      = "md5"
+	checksumSHA1     = "sha1"
+	checksumSHA256   = "sha256"
+	checksumXXHash64 = "xxhash64"
+)
+
+var checksumConstructors = map[string]func() hash.Hash{
+	checksumMD5:      md5.New,
+	checksumSHA1:     sha1.New,
+	checksumSHA256:   sha256.New,
+	checksumXXHash64: func() hash.Hash { return xxhash.New() },
+}
+
+// defaultChecksumAlgorithms is used when a bridge isn't configured with any algorithms.
+var defaultChecksumAlgorithms = []string{checksumMD5}
+
+// parseChecksumAlgorithms parses a comma separated list of checksum algorithms. The first
+// algorithm is the primary one, whose digest is stored as the file checksum. Unknown and
+// duplicate algorithms are ignored.
+func parseChecksumAlgorithms(val string) []string {
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, algorithm := range strings.Split(val, ",") {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if _, ok := checksumConstructors[algorithm]; !ok || seen[algorithm] {
+			continue
+		}
+		seen[algorithm] = true
+		algorithms = append(algorithms, algorithm)
+	}
+
+	if len(algorithms) == 0 {
+		return defaultChecksumAlgorithms
+	}
+
+	return algorithms
+}
+
+// formatChecksum formats a digest for storing as a file checksum. The checksum records the
+// algorithm as a prefix, eg "sha256:<digest>". MD5 checksums have no prefix so that they
+// stay compatible with existing checksums, which are all MD5.
+func formatChecksum(algorithm, digest string) string {
+	if algorithm == checksumMD5 || digest == "" {
+		return digest
+	}
+
+	return algorithm + ":" + digest
+}
+
+// parseChecksum splits a stored file checksum into its algorithm and digest.
+func parseChecksum(checksum string) (algorithm, digest string) {
+	if i := strings.Index(checksum, ":"); i != -1 {
+		return checksum[:i], checksum[i+1:]
+	}
+
+	return checksumMD5, checksum
+}
+
+// multiHasher computes the digests for several checksum algorithms in a single pass.
+type multiHasher struct {
+	algorithms []string
+	hashers    []hash.Hash
+}
+
+func newMultiHasher(algorithms []string) *multiHasher {
+	h := &multiHasher{algorithms: algorithms}
+	for _, algorithm := range algorithms {
+		h.hashers = append(h.hashers, checksumConstructors[algorithm]())
+	}
+
+	return h
+}
+
+func (h *multiHasher) Write(p []byte) (int, error) {
+	for _, hasher := range h.hashers {
+		_, _ = hasher.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// digests returns the hex encoded digest for each algorithm.
+func (h *multiHasher) digests() map[string]string {
+	digests := make(map[string]string, len(h.algorithms))
+	for i, algorithm := range h.algorithms {
+		digests[algorithm] = fmt.Sprintf("%x", h.hashers[i].Sum(nil))
+	}
+
+	return digests
+}
+
+// checkpoint returns the marshaled state of each hasher, keyed by algorithm, so that hashing can
+// be continued later with restoreMultiHasher.
+func (h *multiHasher) checkpoint() (map[string][]byte, error) {
+	states := make(map[string][]byte, len(h.algorithms))
+	for i, algorithm := range h.algorithms {
+		marshaler, ok := h.hashers[i].(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("checksum %s can't be checkpointed", algorithm)
+		}
+
+		state, err := marshaler.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		states[algorithm] = state
+	}
+
+	return states, nil
+}
+
+// restoreMultiHasher creates a multiHasher for the algorithms that continues from the states
+// returned by checkpoint. It fails when there isn't a state for every algorithm.
+func restoreMultiHasher(algorithms []string, states map[string][]byte) (*multiHasher, error) {
+	h := newMultiHasher(algorithms)
+	for i, algorithm := range algorithms {
+		state, ok := states[algorithm]
+		if !ok {
+			return nil, fmt.Errorf("no checkpoint for checksum %s", algorithm)
+		}
+
+		unmarshaler, ok := h.hashers[i].(encoding.BinaryUnmarshaler)
+		if !ok {
+			return nil, fmt.Errorf("checksum %s can't be restored", algorithm)
+		}
+
+		if err := unmarshaler.UnmarshalBinary(state); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// checksumFile computes the digests for the file at path.
+func checksumFile(path string, algorithms []string) (map[string]string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	hasher := newMultiHasher(algorithms)
+	if _, err := io.Copy(hasher, fp); err != nil {
+		return nil, err
+	}
+
+	return hasher.digests(), nil
+}
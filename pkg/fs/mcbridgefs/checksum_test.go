@@ -0,0 +1,76 @@
+package mcbridgefs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChecksumAlgorithms(t *testing.T) {
+	require.Equal(t, []string{checksumMD5}, parseChecksumAlgorithms(""))
+	require.Equal(t, []string{checksumMD5}, parseChecksumAlgorithms("crc32"))
+	require.Equal(t, []string{checksumSHA256, checksumMD5}, parseChecksumAlgorithms("SHA256, md5,sha256"))
+}
+
+func TestFormatAndParseChecksum(t *testing.T) {
+	algorithm, digest := parseChecksum(formatChecksum(checksumSHA256, "abc"))
+	require.Equal(t, checksumSHA256, algorithm)
+	require.Equal(t, "abc", digest)
+
+	// MD5 checksums are stored without a prefix
+	require.Equal(t, "abc", formatChecksum(checksumMD5, "abc"))
+	algorithm, digest = parseChecksum("abc")
+	require.Equal(t, checksumMD5, algorithm)
+	require.Equal(t, "abc", digest)
+}
+
+func TestChecksumFileAllAlgorithms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("hello world"), 0644))
+
+	digests, err := checksumFile(path, []string{checksumMD5, checksumSHA1, checksumSHA256, checksumXXHash64})
+	require.NoError(t, err, "checksumFile failed: %s", err)
+	require.Equal(t, "5eb63bbbe01eeed093cb22bb8f5acdc3", digests[checksumMD5])
+	require.Equal(t, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", digests[checksumSHA1])
+	require.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", digests[checksumSHA256])
+	require.Len(t, digests[checksumXXHash64], 16)
+}
+
+func TestGetDigestComputesMissingDigests(t *testing.T) {
+	defer func(root string, cache *DigestCache, p bridgePolicy) {
+		mcfsRoot, checksumDigests, policy = root, cache, p
+	}(mcfsRoot, checksumDigests, policy)
+
+	mcfsRoot = t.TempDir()
+	checksumDigests = NewDigestCache(10)
+	policy.checksumAlgorithms = []string{checksumSHA256, checksumSHA1}
+
+	f := &mcmodel.File{ID: 1, UUID: "7d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Checksum: "5eb63bbbe01eeed093cb22bb8f5acdc3"}
+	writeBlob(t, mcfsRoot, f, "hello world")
+
+	// The stored md5 checksum isn't a policy algorithm, but is still listed
+	require.Equal(t, []string{checksumSHA256, checksumSHA1, checksumMD5}, digestAlgorithms(f))
+	for _, algorithm := range digestAlgorithms(f) {
+		_, ok := getDigest(f, algorithm)
+		require.True(t, ok, "Listed digest %s should be readable", algorithm)
+	}
+
+	// Digests that aren't cached are computed from the file
+	checksumDigests.Delete(f.ID)
+	digest, ok := getDigest(f, checksumSHA1)
+	require.True(t, ok)
+	require.Equal(t, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", digest)
+
+	_, ok = getDigest(f, checksumXXHash64)
+	require.False(t, ok, "Only the policy algorithms are computed")
+
+	// A file that hasn't been released has no digests
+	f.Checksum = ""
+	checksumDigests.Delete(f.ID)
+	require.Empty(t, digestAlgorithms(f))
+	_, ok = getDigest(f, checksumSHA256)
+	require.False(t, ok)
+}
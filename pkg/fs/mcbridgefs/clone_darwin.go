@@ -0,0 +1,11 @@
+//go:build darwin
+// +build darwin
+
+package mcbridgefs
+
+import "golang.org/x/sys/unix"
+
+// cloneFile isn't supported on darwin for open files, so the contents are always copied.
+func cloneFile(dst, src int) error {
+	return unix.ENOTSUP
+}
@@ -0,0 +1,12 @@
+//go:build linux
+// +build linux
+
+package mcbridgefs
+
+import "golang.org/x/sys/unix"
+
+// cloneFile makes the file dst share the contents of src using a reflink. It fails when the
+// underlying file system doesn't support reflinks.
+func cloneFile(dst, src int) error {
+	return unix.IoctlSetInt(dst, unix.FICLONE, src)
+}
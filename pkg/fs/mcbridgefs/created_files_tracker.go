@@ -0,0 +1,51 @@
+package mcbridgefs
+
+import (
+	"strings"
+	"sync"
+)
+
+// CreatedFilesTracker tracks the paths of files and directories that were created through
+// this bridge during the transfer request. Entries created during the transfer request can be
+// removed without the bridgePolicy allowing deletes of existing entries.
+type CreatedFilesTracker struct {
+	m sync.Map
+}
+
+func NewCreatedFilesTracker() *CreatedFilesTracker {
+	return &CreatedFilesTracker{}
+}
+
+func (t *CreatedFilesTracker) Add(path string) {
+	t.m.Store(path, true)
+}
+
+func (t *CreatedFilesTracker) Has(path string) bool {
+	_, ok := t.m.Load(path)
+	return ok
+}
+
+func (t *CreatedFilesTracker) Delete(path string) {
+	t.m.Delete(path)
+}
+
+// MoveDir moves every path under the directory fromDirPath to be under toDirPath.
+func (t *CreatedFilesTracker) MoveDir(fromDirPath, toDirPath string) {
+	if t.Has(fromDirPath) {
+		t.Delete(fromDirPath)
+		t.Add(toDirPath)
+	}
+
+	for _, path := range pathsUnder(&t.m, fromDirPath) {
+		t.Delete(path)
+		t.Add(toDirPath + strings.TrimPrefix(path, fromDirPath))
+	}
+}
+
+// DeleteDir deletes dirPath and every path below it.
+func (t *CreatedFilesTracker) DeleteDir(dirPath string) {
+	t.Delete(dirPath)
+	for _, path := range pathsUnder(&t.m, dirPath) {
+		t.Delete(path)
+	}
+}
@@ -0,0 +1,149 @@
+package mcbridgefs
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// When a version is released, its contents may already be stored in the project, for example when
+// a folder is transferred again. Rather than keeping a second copy, the version is pointed at the
+// existing blob using uses_uuid/uses_id, the same mechanism Materials Commons uses for files that
+// share their contents, and the duplicate bytes are removed.
+
+// DedupStats are the number of versions deduplicated for a transfer request, and the bytes that
+// were saved by doing so.
+type DedupStats struct {
+	TransferRequestID int
+	Files             uint64
+	BytesSaved        uint64
+}
+
+// dedupCounter counts the versions deduplicated for the transfer request a bridge is serving.
+// CreateFS starts a new one for each transfer request.
+type dedupCounter struct {
+	transferRequestID int
+	files             uint64
+	bytesSaved        uint64
+}
+
+func newDedupCounter(transferRequestID int) *dedupCounter {
+	return &dedupCounter{transferRequestID: transferRequestID}
+}
+
+// add counts a deduplicated version of size bytes.
+func (c *dedupCounter) add(size int64) {
+	atomic.AddUint64(&c.files, 1)
+	atomic.AddUint64(&c.bytesSaved, uint64(size))
+}
+
+func (c *dedupCounter) stats() DedupStats {
+	return DedupStats{
+		TransferRequestID: c.transferRequestID,
+		Files:             atomic.LoadUint64(&c.files),
+		BytesSaved:        atomic.LoadUint64(&c.bytesSaved),
+	}
+}
+
+// GetDedupStats returns the deduplication stats for the transfer request the bridge is serving.
+func GetDedupStats() DedupStats {
+	return dedupStats.stats()
+}
+
+// dedupFileVersion points the released version f at an existing blob in the project with the same
+// checksum and size, and removes f's own copy of the bytes. Nothing happens when there isn't one.
+// Failures are logged and leave f with its own copy, which is always safe.
+func dedupFileVersion(f *mcmodel.File, checksum string, size int64) {
+	// A symlink holds its target rather than contents, so it's never deduplicated.
+	if checksum == "" || size == 0 || f.UsesUUID != "" || isSymlink(f) {
+		return
+	}
+
+	query := db.Where("project_id = ?", f.ProjectID).
+		Where("checksum = ?", checksum).
+		Where("size = ?", size).
+		Where("id <> ?", f.ID).
+		Where("mime_type <> ?", "directory").
+		Where("mime_type <> ?", symlinkMimeType).
+		Where("deleted_at IS NULL")
+
+	// Versions still being written to can change after they are checked
+	if ids := openedFilesTracker.FileIDs(); len(ids) != 0 {
+		query = query.Where("id not in ?", ids)
+	}
+
+	var existing []mcmodel.File
+	if err := query.Order("id").Limit(1).Find(&existing).Error; err != nil {
+		log.Errorf("Failed looking for duplicates of version %d of %s: %s", f.ID, f.Name, err)
+		return
+	}
+
+	if len(existing) == 0 || !isDedupTarget(&existing[0], size) {
+		return
+	}
+
+	blobUUID, blobID := existing[0].UUID, existing[0].ID
+	if existing[0].UsesUUID != "" {
+		blobUUID, blobID = existing[0].UsesUUID, existing[0].UsesID
+	}
+
+	ownPath := f.ToUnderlyingFilePath(mcfsRoot)
+
+	err := withTxRetry(func(tx *gorm.DB) error {
+		return tx.Model(&mcmodel.File{}).
+			Where("id = ?", f.ID).
+			Updates(map[string]interface{}{"uses_uuid": blobUUID, "uses_id": blobID}).Error
+	}, db, txRetryCount)
+
+	if err != nil {
+		log.Errorf("Failed deduplicating version %d of %s: %s", f.ID, f.Name, err)
+		return
+	}
+
+	f.UsesUUID, f.UsesID = blobUUID, blobID
+
+	// The database no longer refers to the bytes, so a failure here only wastes space.
+	if err := os.Remove(ownPath); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed removing duplicate contents of version %d of %s: %s", f.ID, f.Name, err)
+		return
+	}
+
+	dedupStats.add(size)
+}
+
+// isDedupTarget returns true when a version of size bytes can be pointed at the blob of existing.
+// Only the checksum was matched in the database, so it's only trusted when the blob it refers to is
+// actually there and has the same size.
+func isDedupTarget(existing *mcmodel.File, size int64) bool {
+	if existing.IsDir() || isSymlink(existing) {
+		return false
+	}
+
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(existing.ToUnderlyingFilePath(mcfsRoot), &st); err != nil {
+		return false
+	}
+
+	return st.Size == size
+}
+
+// sharesBlob returns true when f's contents are shared with other files, either because f uses
+// another file's blob or because other files use f's. Such contents must never be written to.
+func sharesBlob(f *mcmodel.File) (bool, error) {
+	return blobIsShared(db, f)
+}
+
+// blobIsShared is sharesBlob, looking up the files using f's blob in tx.
+func blobIsShared(tx *gorm.DB, f *mcmodel.File) (bool, error) {
+	if f.UsesUUID != "" {
+		return true, nil
+	}
+
+	var count int64
+	err := tx.Model(&mcmodel.File{}).Where("uses_uuid = ?", f.UUID).Count(&count).Error
+	return count != 0, err
+}
@@ -0,0 +1,63 @@
+package mcbridgefs
+
+import (
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsDedupTarget(t *testing.T) {
+	defer func(root string) { mcfsRoot = root }(mcfsRoot)
+	mcfsRoot = t.TempDir()
+
+	existing := &mcmodel.File{ID: 1, UUID: "2d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", MimeType: "text/plain"}
+	require.False(t, isDedupTarget(existing, 11), "A missing blob can't be shared")
+
+	writeBlob(t, mcfsRoot, existing, "hello world")
+	require.True(t, isDedupTarget(existing, 11))
+	require.False(t, isDedupTarget(existing, 5), "A blob of the wrong size can't be shared")
+
+	existing.MimeType = symlinkMimeType
+	require.False(t, isDedupTarget(existing, 11), "A symlink's target can't be shared")
+
+	existing.MimeType = "directory"
+	require.False(t, isDedupTarget(existing, 11), "Directories have no blob to share")
+}
+
+func TestIsDedupTargetFollowsSharedBlob(t *testing.T) {
+	defer func(root string) { mcfsRoot = root }(mcfsRoot)
+	mcfsRoot = t.TempDir()
+
+	blob := &mcmodel.File{ID: 1, UUID: "3d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f"}
+	existing := &mcmodel.File{ID: 2, UUID: "4d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", UsesUUID: blob.UUID, UsesID: blob.ID}
+
+	// The blob checked is the one existing uses, not its own
+	writeBlob(t, mcfsRoot, &mcmodel.File{UUID: existing.UUID}, "hello world")
+	require.False(t, isDedupTarget(existing, 11))
+
+	writeBlob(t, mcfsRoot, blob, "hello world")
+	require.True(t, isDedupTarget(existing, 11))
+}
+
+func TestSharesBlobUsingAnotherBlob(t *testing.T) {
+	// A version using another file's blob is known to share it without asking the database
+	f := &mcmodel.File{ID: 2, UUID: "5d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", UsesUUID: "3d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", UsesID: 1}
+
+	shared, err := sharesBlob(f)
+	require.NoError(t, err)
+	require.True(t, shared)
+}
+
+func TestDedupStatsArePerTransferRequest(t *testing.T) {
+	defer func(stats *dedupCounter) { dedupStats = stats }(dedupStats)
+
+	dedupStats = newDedupCounter(1)
+	dedupStats.add(10)
+	dedupStats.add(5)
+	require.Equal(t, DedupStats{TransferRequestID: 1, Files: 2, BytesSaved: 15}, GetDedupStats())
+
+	// A bridge serving another transfer request starts counting again
+	dedupStats = newDedupCounter(2)
+	require.Equal(t, DedupStats{TransferRequestID: 2}, GetDedupStats())
+}
@@ -0,0 +1,35 @@
+package mcbridgefs
+
+// DigestCache holds the digests computed for the files released by this bridge, keyed by the file
+// id. Only the primary digest is stored in the database, so the others are kept here to be served
+// through the mount. The cache holds the digests for at most size files, evicting the least
+// recently used ones once it's full. Evicted digests are computed again when they are next read.
+type DigestCache struct {
+	cache *lruCache
+}
+
+// NewDigestCache creates a new DigestCache holding the digests for up to size files.
+func NewDigestCache(size int) *DigestCache {
+	return &DigestCache{cache: newLRUCache(size, 0)}
+}
+
+// Get returns the digests for the file with id fileID, keyed by algorithm. The map returned must
+// not be modified.
+func (c *DigestCache) Get(fileID int) (digests map[string]string, ok bool) {
+	value, ok := c.cache.get(fileID)
+	if !ok {
+		return nil, false
+	}
+
+	return value.(map[string]string), true
+}
+
+// Store caches digests for the file with id fileID. The map must not be modified afterwards.
+func (c *DigestCache) Store(fileID int, digests map[string]string) {
+	c.cache.store(fileID, digests)
+}
+
+// Delete removes the digests for the file with id fileID.
+func (c *DigestCache) Delete(fileID int) {
+	c.cache.remove(fileID)
+}
@@ -0,0 +1,199 @@
+package mcbridgefs
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// mcDirStream is a fs.DirStream that pages through a Materials Commons directory rather than
+// loading it all at once. Pages are read using keyset pagination on the file id, so each page is
+// a cheap index range scan no matter how far into the directory the listing is.
+//
+// The listing happens in two phases. The first lists the current entries in the directory. The
+// second lists the files being written in this transfer request that don't have a current
+// version yet, which are only visible to this bridge.
+type mcDirStream struct {
+	dir      *mcmodel.File
+	dirPath  string
+	pageSize int
+
+	phase  int
+	lastID int
+	page   []mcmodel.File
+	next   int
+	errno  syscall.Errno
+	closed bool
+
+	// identityIDs are the inode identity ids for the files in page.
+	identityIDs map[string]int
+}
+
+const (
+	dirStreamCurrentPhase = iota
+	dirStreamInProgressPhase
+	dirStreamDonePhase
+)
+
+var _ = (fs.DirStream)((*mcDirStream)(nil))
+
+// readdirEntries holds the entries in the page each mcDirStream is currently returning, keyed by
+// path. With READDIRPLUS the kernel looks up every entry as it is listed, so Lookup uses these
+// rather than querying for the entry again. Only the current page is kept so that listing a
+// large directory doesn't hold on to every entry.
+var readdirEntries sync.Map
+
+type readdirEntry struct {
+	file       *mcmodel.File
+	stableAttr fs.StableAttr
+}
+
+func newMCDirStream(dir *mcmodel.File, dirPath string, pageSize int) *mcDirStream {
+	return &mcDirStream{dir: dir, dirPath: dirPath, pageSize: pageSize}
+}
+
+// HasNext reads the next page when the current one has been returned. Errors reading a page are
+// returned by the following call to Next.
+func (s *mcDirStream) HasNext() bool {
+	if s.closed {
+		return false
+	}
+
+	for s.errno == fs.OK && s.next >= len(s.page) && s.phase != dirStreamDonePhase {
+		s.loadPage()
+	}
+
+	return s.errno != fs.OK || s.next < len(s.page)
+}
+
+func (s *mcDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if s.errno != fs.OK {
+		errno := s.errno
+		s.Close()
+		return fuse.DirEntry{}, errno
+	}
+
+	f := &s.page[s.next]
+	s.next++
+
+	identityID, ok := s.identityIDs[f.Name]
+	if !ok || f.IsDir() {
+		identityID = f.ID
+	}
+
+	stableAttr := stableAttrFor(f, identityID)
+	path := filepath.Join(s.dirPath, f.Name)
+	readdirEntries.Store(path, readdirEntry{file: f, stableAttr: stableAttr})
+
+	// Listing a directory is usually followed by a stat of each entry, so prime the attribute
+	// cache. Directories are skipped as their attributes need a query of their own.
+	if !f.IsDir() {
+		var attr fuse.Attr
+		_ = getEntryAttr(path, f, stableAttr.Ino, &attr)
+	}
+
+	return fuse.DirEntry{Name: f.Name, Mode: stableAttr.Mode, Ino: stableAttr.Ino}, fs.OK
+}
+
+func (s *mcDirStream) Close() {
+	s.releasePage()
+	s.closed = true
+}
+
+// loadPage reads the next page for the current phase, moving on to the next phase when the
+// current one has no more entries.
+func (s *mcDirStream) loadPage() {
+	s.releasePage()
+
+	var query *gorm.DB
+	switch s.phase {
+	case dirStreamCurrentPhase:
+		query = currentEntriesQuery(db, s.dir.ID)
+	case dirStreamInProgressPhase:
+		query = inProgressEntriesQuery(db, s.dir.ID)
+	}
+
+	var page []mcmodel.File
+	err := query.Where("id > ?", s.lastID).Order("id").Limit(s.pageSize).Find(&page).Error
+	if err != nil {
+		log.Errorf("Readdir: failed reading entries in %s: %s", s.dirPath, err)
+		s.errno = syscall.EIO
+		return
+	}
+
+	if len(page) < s.pageSize {
+		s.phase++
+		s.lastID = 0
+	} else {
+		s.lastID = page[len(page)-1].ID
+	}
+
+	// Every entry is in the directory being listed, so it's set here rather than preloaded. Nodes
+	// looked up from the listing need it to create new versions.
+	names := make([]string, 0, len(page))
+	for i := range page {
+		page[i].Directory = s.dir
+		if !page[i].IsDir() {
+			names = append(names, page[i].Name)
+		}
+	}
+
+	if s.identityIDs, err = getFileIdentityIDs(s.dir.ID, names); err != nil {
+		log.Errorf("Readdir: failed reading inode ids in %s: %s", s.dirPath, err)
+		s.errno = syscall.EIO
+		return
+	}
+
+	s.page = page
+	s.next = 0
+}
+
+// releasePage drops the entries for the current page from readdirEntries.
+func (s *mcDirStream) releasePage() {
+	for _, f := range s.page {
+		readdirEntries.Delete(filepath.Join(s.dirPath, f.Name))
+	}
+
+	s.page = nil
+	s.next = 0
+}
+
+// getReaddirEntry returns the entry for path if it is in a page currently being listed.
+func getReaddirEntry(path string) (readdirEntry, bool) {
+	val, ok := readdirEntries.Load(path)
+	if !ok {
+		return readdirEntry{}, false
+	}
+
+	return val.(readdirEntry), true
+}
+
+// currentEntriesQuery builds the query for the current files and directories in a directory.
+func currentEntriesQuery(tx *gorm.DB, dirID int) *gorm.DB {
+	return tx.Model(&mcmodel.File{}).
+		Where("directory_id = ?", dirID).
+		Where("current = ?", true).
+		Where("deleted_at IS NULL")
+}
+
+// inProgressEntriesQuery builds the query for the files being written in this transfer request
+// that don't have a current version.
+func inProgressEntriesQuery(tx *gorm.DB, dirID int) *gorm.DB {
+	transferRequestFileIDs := tx.Model(&mcmodel.TransferRequestFile{}).
+		Select("file_id").
+		Where("transfer_request_id = ?", transferRequest.ID).
+		Where("directory_id = ?", dirID)
+
+	return tx.Model(&mcmodel.File{}).
+		Where("directory_id = ?", dirID).
+		Where("current = ?", false).
+		Where("deleted_at IS NULL").
+		Where("id in (?)", transferRequestFileIDs).
+		Where("name not in (?)", currentEntriesQuery(tx, dirID).Select("name"))
+}
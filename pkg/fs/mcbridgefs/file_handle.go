@@ -1,9 +1,7 @@
 package mcbridgefs
 
 import (
-	"bytes"
 	"context"
-	"io"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -18,6 +16,11 @@ type FileHandle struct {
 	*bridgefs.BridgeFileHandle
 	Flags uint32
 	Path  string
+
+	// openFile is the openedFilesTracker entry for Path when the handle was opened for write. The
+	// handle holds a reference to it until it's released. It is held on to so that writes still
+	// update the checksum after the file is renamed.
+	openFile *OpenFile
 }
 
 var _ = (fs.FileHandle)((*FileHandle)(nil))
@@ -34,11 +37,12 @@ var _ = (fs.FileFsyncer)((*FileHandle)(nil))
 var _ = (fs.FileSetattrer)((*FileHandle)(nil))
 var _ = (fs.FileAllocater)((*FileHandle)(nil))
 
-func NewFileHandle(fd int, flags uint32, path string) fs.FileHandle {
+func NewFileHandle(fd int, flags uint32, path string, openFile *OpenFile) fs.FileHandle {
 	return &FileHandle{
 		BridgeFileHandle: bridgefs.NewBridgeFileHandle(fd).(*bridgefs.BridgeFileHandle),
 		Flags:            flags,
 		Path:             path,
+		openFile:         openFile,
 	}
 }
 
@@ -55,9 +59,15 @@ func (f *FileHandle) Write(ctx context.Context, data []byte, off int64) (uint32,
 		return uint32(n), fs.ToErrno(err)
 	}
 
-	file := openedFilesTracker.Get(f.Path)
-	if file != nil && n > 0 {
-		_, _ = io.Copy(file.hasher, bytes.NewBuffer(data[:n]))
+	if f.openFile != nil && n > 0 {
+		if f.Flags&syscall.O_APPEND != 0 {
+			// Writes to a file opened for append always go to the end of the file, whatever offset
+			// was passed in. Where that was can't be told reliably when other handles are writing
+			// too, so the checksum is computed from the file on release instead.
+			f.openFile.recordUnknownWrite()
+		} else {
+			f.openFile.recordWrite(data[:n], off)
+		}
 	}
 
 	return uint32(n), fs.OK
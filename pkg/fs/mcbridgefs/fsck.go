@@ -0,0 +1,428 @@
+package mcbridgefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// Fsck reconciles the files of a project in the database with the blobs in the underlying storage.
+// Crashes can leave the two out of step, so it looks for:
+//
+//	missing-blob      - a file whose blob doesn't exist
+//	size-mismatch     - a file whose blob isn't the size recorded for it
+//	checksum-mismatch - a file whose blob doesn't match the checksum recorded for it
+//	orphaned-blob     - a blob in the storage that no file refers to
+//	aborted-version   - a version that was never finished, left by a transfer that is no longer open
+//
+// Each problem records the repair Fsck makes for it when repairing. Problems that could mean the
+// contents were damaged, such as a checksum mismatch, are only reported.
+//
+// The storage is shared by every project, so orphaned blobs can't be attributed to the project
+// being checked. Looking for them walks the whole storage, which is only done when CheckOrphans or
+// RemoveOrphans is set, and they are only removed when RemoveOrphans is set.
+type Fsck struct {
+	db        *gorm.DB
+	mcfsRoot  string
+	projectID int
+
+	// VerifyChecksums reads every blob to check its checksum. Without it only sizes are checked.
+	VerifyChecksums bool
+
+	// CheckOrphans walks the whole storage, not just the project's blobs, and reports the blobs that
+	// no file in any project refers to.
+	CheckOrphans bool
+
+	// RemoveOrphans checks for orphaned blobs like CheckOrphans, and removes them when repairing.
+	RemoveOrphans bool
+}
+
+// The kinds of problems Fsck finds.
+const (
+	fsckMissingBlob      = "missing-blob"
+	fsckSizeMismatch     = "size-mismatch"
+	fsckChecksumMismatch = "checksum-mismatch"
+	fsckOrphanedBlob     = "orphaned-blob"
+	fsckAbortedVersion   = "aborted-version"
+)
+
+// fsckPageSize is the number of files read in each query.
+const fsckPageSize = 1000
+
+// fsckOrphanGracePeriod is how old a blob without a file has to be before it's an orphan. A blob
+// that was just written may belong to a file that is in the middle of being created or removed.
+const fsckOrphanGracePeriod = time.Hour
+
+// blobNameRegex matches the names of blobs, which are the uuid of the file they belong to.
+var blobNameRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// FsckReport is the result of checking a project. When Repair is false it's a dry run, showing the
+// repairs that would be made.
+type FsckReport struct {
+	ProjectID    int           `json:"project_id"`
+	Repair       bool          `json:"repair"`
+	FilesChecked int           `json:"files_checked"`
+	BlobsChecked int           `json:"blobs_checked"`
+	Problems     []FsckProblem `json:"problems"`
+}
+
+// FsckProblem is a single problem found by Fsck.
+type FsckProblem struct {
+	Kind     string `json:"kind"`
+	FileID   int    `json:"file_id,omitempty"`
+	Path     string `json:"path,omitempty"`
+	BlobPath string `json:"blob_path"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+
+	// Repair describes what repairing does for the problem. It's empty when the problem has to be
+	// looked at by hand.
+	Repair   string `json:"repair,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Unrepaired returns the number of problems that haven't been repaired.
+func (r *FsckReport) Unrepaired() int {
+	count := 0
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			count++
+		}
+	}
+
+	return count
+}
+
+// NewFsck creates an Fsck for the project with id projectID, whose blobs are stored under mcfsRoot.
+func NewFsck(db *gorm.DB, mcfsRoot string, projectID int) *Fsck {
+	return &Fsck{db: db, mcfsRoot: mcfsRoot, projectID: projectID, VerifyChecksums: true}
+}
+
+// Run checks the project. When repair is true the problems that can be repaired are.
+func (c *Fsck) Run(repair bool) (*FsckReport, error) {
+	report := &FsckReport{ProjectID: c.projectID, Repair: repair, Problems: []FsckProblem{}}
+
+	if err := c.checkFiles(report, repair); err != nil {
+		return report, err
+	}
+
+	if !c.CheckOrphans && !c.RemoveOrphans {
+		return report, nil
+	}
+
+	if err := c.checkOrphanedBlobs(report, repair); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// checkFiles checks the blob of every file in the project, a page at a time.
+func (c *Fsck) checkFiles(report *FsckReport, repair bool) error {
+	inProgress, aborted, err := c.getTransferFileIDs()
+	if err != nil {
+		return err
+	}
+
+	lastID := 0
+	for {
+		var files []mcmodel.File
+		err := c.db.Preload("Directory").
+			Where("project_id = ?", c.projectID).
+			Where("mime_type <> ?", "directory").
+			Where("deleted_at IS NULL").
+			Where("id > ?", lastID).
+			Order("id").
+			Limit(fsckPageSize).
+			Find(&files).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range files {
+			f := &files[i]
+
+			// Files still being written to by an open transfer are in flux
+			if inProgress[f.ID] {
+				continue
+			}
+
+			report.FilesChecked++
+			if problem := c.checkFile(f, aborted[f.ID]); problem != nil {
+				if repair {
+					c.repair(f, problem)
+				}
+				report.Problems = append(report.Problems, *problem)
+			}
+		}
+
+		if len(files) < fsckPageSize {
+			return nil
+		}
+
+		lastID = files[len(files)-1].ID
+	}
+}
+
+// getTransferFileIDs returns the ids of the files written by transfers. inProgress are the files
+// for transfers that are still open. aborted are the files for transfers that aren't.
+func (c *Fsck) getTransferFileIDs() (inProgress, aborted map[int]bool, err error) {
+	openTransferRequestIDs := c.db.Model(&mcmodel.TransferRequest{}).Select("id").Where("state = ?", "open")
+
+	var inProgressIDs, abortedIDs []int
+	err = c.db.Model(&mcmodel.TransferRequestFile{}).
+		Where("project_id = ?", c.projectID).
+		Where("transfer_request_id in (?)", openTransferRequestIDs).
+		Pluck("file_id", &inProgressIDs).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = c.db.Model(&mcmodel.TransferRequestFile{}).
+		Where("project_id = ?", c.projectID).
+		Where("transfer_request_id not in (?)", openTransferRequestIDs).
+		Pluck("file_id", &abortedIDs).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return toIDSet(inProgressIDs), toIDSet(abortedIDs), nil
+}
+
+// checkFile checks the blob for f. transferred is true when f was written by a transfer that is no
+// longer open. It returns nil when there's nothing wrong.
+func (c *Fsck) checkFile(f *mcmodel.File, transferred bool) *FsckProblem {
+	blobPath := f.ToUnderlyingFilePath(c.mcfsRoot)
+	problem := &FsckProblem{FileID: f.ID, Path: f.FullPath(), BlobPath: blobPath}
+
+	// A version that was never released has no checksum or size, and never became current. A
+	// released version has its size set even when computing its checksum failed.
+	if transferred && !f.Current && f.Checksum == "" && f.Size == 0 {
+		problem.Kind = fsckAbortedVersion
+		problem.Repair = "remove the version, and its blob unless it's shared"
+		return problem
+	}
+
+	info, err := os.Stat(blobPath)
+	switch {
+	case os.IsNotExist(err):
+		problem.Kind = fsckMissingBlob
+		if !f.Current {
+			problem.Repair = "soft delete the version"
+		}
+		return problem
+	case err != nil:
+		problem.Kind = fsckMissingBlob
+		problem.Error = err.Error()
+		return problem
+	}
+
+	checksum, checksumErr := c.blobChecksum(f, blobPath)
+
+	if uint64(info.Size()) != f.Size {
+		problem.Kind = fsckSizeMismatch
+		problem.Expected = fmt.Sprintf("%d", f.Size)
+		problem.Actual = fmt.Sprintf("%d", info.Size())
+
+		// When the checksum was verified and still matches, the contents are what was uploaded and
+		// only the size recorded for them is wrong.
+		if c.VerifyChecksums && f.Checksum != "" && checksumErr == nil && checksum == f.Checksum {
+			problem.Repair = "update the size from the blob"
+		}
+		return problem
+	}
+
+	switch {
+	case checksumErr != nil:
+		problem.Kind = fsckChecksumMismatch
+		problem.Error = checksumErr.Error()
+		return problem
+	case checksum != f.Checksum:
+		problem.Kind = fsckChecksumMismatch
+		problem.Expected = f.Checksum
+		problem.Actual = checksum
+		return problem
+	}
+
+	return nil
+}
+
+// blobChecksum returns the checksum of the blob at blobPath, using the algorithm of f's checksum.
+// It returns f's checksum when checksums aren't being verified, or f doesn't have one.
+func (c *Fsck) blobChecksum(f *mcmodel.File, blobPath string) (string, error) {
+	if !c.VerifyChecksums || f.Checksum == "" {
+		return f.Checksum, nil
+	}
+
+	algorithm, _ := parseChecksum(f.Checksum)
+	if _, ok := checksumConstructors[algorithm]; !ok {
+		return "", fmt.Errorf("unknown checksum algorithm %s", algorithm)
+	}
+
+	digests, err := checksumFile(blobPath, []string{algorithm})
+	if err != nil {
+		return "", err
+	}
+
+	return formatChecksum(algorithm, digests[algorithm]), nil
+}
+
+// repair makes the repair for problem, if there is one.
+func (c *Fsck) repair(f *mcmodel.File, problem *FsckProblem) {
+	if problem.Repair == "" {
+		return
+	}
+
+	var err error
+	switch problem.Kind {
+	case fsckAbortedVersion:
+		// The blob of a version that uses, or is used by, another file belongs to that file too
+		var shared bool
+		if shared, err = blobIsShared(c.db, f); err != nil {
+			break
+		}
+
+		err = withTxRetry(func(tx *gorm.DB) error {
+			if err := tx.Where("file_id = ?", f.ID).Delete(&mcmodel.TransferRequestFile{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Delete(&mcmodel.File{}, f.ID).Error
+		}, c.db, txRetryCount)
+
+		if err == nil && !shared {
+			if err = os.Remove(problem.BlobPath); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+	case fsckMissingBlob:
+		err = withTxRetry(func(tx *gorm.DB) error {
+			return softDeleteFiles(tx, f.ID)
+		}, c.db, txRetryCount)
+	case fsckSizeMismatch:
+		var info os.FileInfo
+		if info, err = os.Stat(problem.BlobPath); err == nil {
+			err = withTxRetry(func(tx *gorm.DB) error {
+				return tx.Model(&mcmodel.File{}).Where("id = ?", f.ID).UpdateColumn("size", info.Size()).Error
+			}, c.db, txRetryCount)
+		}
+	case fsckOrphanedBlob:
+		err = os.Remove(problem.BlobPath)
+	}
+
+	if err != nil {
+		problem.Error = err.Error()
+		return
+	}
+
+	problem.Repaired = true
+}
+
+// checkOrphanedBlobs walks the whole underlying storage for blobs that no file refers to. Blobs
+// are shared by all projects, and a blob can be used by other files through uses_uuid, so every
+// file, including removed ones, is checked against. Blobs are looked up a batch at a time.
+func (c *Fsck) checkOrphanedBlobs(report *FsckReport, repair bool) error {
+	batch := make(map[string]string, fsckPageSize)
+
+	checkBatch := func() error {
+		orphans, err := c.findUnreferencedBlobs(batch)
+		if err != nil {
+			return err
+		}
+
+		for _, blobPath := range orphans {
+			problem := FsckProblem{Kind: fsckOrphanedBlob, BlobPath: blobPath}
+			if c.RemoveOrphans {
+				problem.Repair = "remove the blob"
+			}
+			if repair {
+				c.repair(nil, &problem)
+			}
+			report.Problems = append(report.Problems, problem)
+		}
+
+		batch = make(map[string]string, fsckPageSize)
+		return nil
+	}
+
+	err := filepath.Walk(c.mcfsRoot, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case !info.Mode().IsRegular() || !blobNameRegex.MatchString(info.Name()):
+			return nil
+		case time.Since(info.ModTime()) < fsckOrphanGracePeriod:
+			return nil
+		}
+
+		report.BlobsChecked++
+		batch[info.Name()] = path
+		if len(batch) < fsckPageSize {
+			return nil
+		}
+
+		return checkBatch()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return checkBatch()
+}
+
+// findUnreferencedBlobs returns the paths of the blobs in batch, which maps the blob uuid to its
+// path, that no file refers to.
+func (c *Fsck) findUnreferencedBlobs(batch map[string]string) ([]string, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	uuids := make([]string, 0, len(batch))
+	for uuid := range batch {
+		uuids = append(uuids, uuid)
+	}
+
+	var refs []struct {
+		UUID     string
+		UsesUUID string
+	}
+
+	err := c.db.Model(&mcmodel.File{}).
+		Select("uuid, uses_uuid").
+		Where("uuid in ? OR uses_uuid in ?", uuids, uuids).
+		Scan(&refs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool, len(refs)*2)
+	for _, ref := range refs {
+		referenced[ref.UUID] = true
+		referenced[ref.UsesUUID] = true
+	}
+
+	var orphans []string
+	for uuid, path := range batch {
+		if !referenced[uuid] {
+			orphans = append(orphans, path)
+		}
+	}
+
+	return orphans, nil
+}
+
+func toIDSet(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	return set
+}
@@ -0,0 +1,72 @@
+package mcbridgefs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBlob writes contents as the blob for f under mcfsRoot.
+func writeBlob(t *testing.T, mcfsRoot string, f *mcmodel.File, contents string) {
+	blobPath := f.ToUnderlyingFilePath(mcfsRoot)
+	require.NoError(t, os.MkdirAll(filepath.Dir(blobPath), 0755))
+	require.NoError(t, ioutil.WriteFile(blobPath, []byte(contents), 0644))
+}
+
+func TestFsckCheckFile(t *testing.T) {
+	mcfsRoot := t.TempDir()
+	c := NewFsck(nil, mcfsRoot, 1)
+
+	// md5 of "hello world"
+	f := &mcmodel.File{ID: 1, UUID: "0d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Size: 11, Checksum: "5eb63bbbe01eeed093cb22bb8f5acdc3", Current: true}
+
+	problem := c.checkFile(f, false)
+	require.NotNil(t, problem)
+	require.Equal(t, fsckMissingBlob, problem.Kind)
+	require.Empty(t, problem.Repair, "A missing current version can't be repaired")
+
+	writeBlob(t, mcfsRoot, f, "hello world")
+	require.Nil(t, c.checkFile(f, false))
+
+	writeBlob(t, mcfsRoot, f, "hello there")
+	problem = c.checkFile(f, false)
+	require.NotNil(t, problem)
+	require.Equal(t, fsckChecksumMismatch, problem.Kind)
+	require.Empty(t, problem.Repair, "A checksum mismatch should only be reported")
+
+	writeBlob(t, mcfsRoot, f, "hello world")
+	f.Size = 5
+	problem = c.checkFile(f, false)
+	require.NotNil(t, problem)
+	require.Equal(t, fsckSizeMismatch, problem.Kind)
+	require.NotEmpty(t, problem.Repair, "The size can be repaired when the checksum matches")
+
+	c.VerifyChecksums = false
+	problem = c.checkFile(f, false)
+	require.NotNil(t, problem)
+	require.Empty(t, problem.Repair, "The size can't be repaired without verifying the checksum")
+}
+
+func TestFsckAbortedVersion(t *testing.T) {
+	c := NewFsck(nil, t.TempDir(), 1)
+	f := &mcmodel.File{ID: 2, UUID: "1d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f"}
+
+	problem := c.checkFile(f, true)
+	require.NotNil(t, problem)
+	require.Equal(t, fsckAbortedVersion, problem.Kind)
+
+	f.Checksum = "abc"
+	problem = c.checkFile(f, true)
+	require.NotNil(t, problem)
+	require.NotEqual(t, fsckAbortedVersion, problem.Kind, "Released versions weren't aborted")
+
+	f.Checksum = ""
+	f.Size = 11
+	problem = c.checkFile(f, true)
+	require.NotNil(t, problem)
+	require.NotEqual(t, fsckAbortedVersion, problem.Kind, "Released versions whose checksum failed weren't aborted")
+}
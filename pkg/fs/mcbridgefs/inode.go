@@ -0,0 +1,162 @@
+package mcbridgefs
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// Inode numbers are derived from database ids so that they are stable across lookups, renames and
+// bridge restarts. A directory is a single row, so its id is used. A file has a row for each
+// version, so the id of its first version is used, even once that version is removed, and the
+// generation number is the id of the version being presented. The generation changes whenever a
+// different version becomes current.
+//
+// Inode 1 is the root of the mount, so ids are offset by one.
+
+// inodeNumber returns the inode number for the entry whose identity id is identityID.
+func inodeNumber(identityID int) uint64 {
+	return uint64(identityID) + 1
+}
+
+// identityIDOf returns the identity id for the inode number ino.
+func identityIDOf(ino uint64) int {
+	return int(ino - 1)
+}
+
+// stableAttr returns the fs.StableAttr for entry, which is the child of n called entry.Name. The
+// identity of a file is taken from the inode the kernel already has for it, and is only looked up
+// when there isn't one.
+func (n *Node) stableAttr(entry *mcmodel.File) fs.StableAttr {
+	identityID := entry.ID
+	if !entry.IsDir() {
+		if child := n.GetChild(entry.Name); child != nil && child.StableAttr().Mode == stableAttrFor(entry, 0).Mode {
+			identityID = identityIDOf(child.StableAttr().Ino)
+		} else if id, err := getFileIdentityID(entry); err == nil {
+			identityID = id
+		}
+	}
+
+	return stableAttrFor(entry, identityID)
+}
+
+// newChildInode returns the inode for node, the child of n that was looked up or created as
+// node.file. The kernel may already know the inode, in which case NewInode returns the existing
+// one rather than node, so its file is refreshed to the entry that was just looked up.
+func (n *Node) newChildInode(ctx context.Context, node *Node, stableAttr fs.StableAttr) *fs.Inode {
+	inode := n.NewInode(ctx, node, stableAttr)
+	if existing, ok := inode.Operations().(*Node); ok && existing != node {
+		existing.file = node.file
+	}
+
+	return inode
+}
+
+// stableAttrFor returns the fs.StableAttr for entry when its identity id is already known.
+func stableAttrFor(entry *mcmodel.File, identityID int) fs.StableAttr {
+	attr := fs.StableAttr{
+		Ino: inodeNumber(identityID),
+		Gen: 1,
+	}
+
+	switch {
+	case entry.IsDir():
+		attr.Mode = syscall.S_IFDIR
+	case isSymlink(entry):
+		attr.Mode = syscall.S_IFLNK
+		attr.Gen = uint64(entry.ID)
+	default:
+		attr.Mode = syscall.S_IFREG
+		attr.Gen = uint64(entry.ID)
+	}
+
+	return attr
+}
+
+// fileVersionRow is the part of a file version needed to work out the identity of the file.
+type fileVersionRow struct {
+	ID        int
+	Name      string
+	CreatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// getFileIdentityID returns the identity id of a file.
+func getFileIdentityID(f *mcmodel.File) (int, error) {
+	var versions []fileVersionRow
+	err := db.Model(&mcmodel.File{}).
+		Select("id, name, created_at, deleted_at").
+		Where("directory_id = ?", f.DirectoryID).
+		Where("name = ?", f.Name).
+		Where("mime_type <> ?", "directory").
+		Order("id").
+		Scan(&versions).Error
+	if err != nil || len(versions) == 0 {
+		return f.ID, err
+	}
+
+	return fileIdentityID(versions), nil
+}
+
+// getFileIdentityIDs returns the identity id of each of the named files in a directory, keyed by
+// the file name.
+func getFileIdentityIDs(dirID int, names []string) (map[string]int, error) {
+	ids := make(map[string]int, len(names))
+	if len(names) == 0 {
+		return ids, nil
+	}
+
+	var rows []fileVersionRow
+	err := db.Model(&mcmodel.File{}).
+		Select("id, name, created_at, deleted_at").
+		Where("directory_id = ?", dirID).
+		Where("name in ?", names).
+		Where("mime_type <> ?", "directory").
+		Order("id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	versionsByName := make(map[string][]fileVersionRow)
+	for _, row := range rows {
+		versionsByName[row.Name] = append(versionsByName[row.Name], row)
+	}
+
+	for name, versions := range versionsByName {
+		ids[name] = fileIdentityID(versions)
+	}
+
+	return ids, nil
+}
+
+// fileIdentityID returns the identity id of a file from all of its versions, including the deleted
+// ones, ordered by id. The identity is the first version, whether or not it has since been removed,
+// so that it doesn't change as versions are removed. The exception is when every version of the
+// file was removed before the next one was created. The file was then deleted and created again,
+// so it's a different file and its identity is the first version created since.
+func fileIdentityID(versions []fileVersionRow) int {
+	var (
+		identityID int
+		live       bool
+		removedAt  time.Time
+	)
+
+	for i, v := range versions {
+		if i == 0 || (!live && !removedAt.After(v.CreatedAt)) {
+			identityID = v.ID
+		}
+
+		switch {
+		case v.DeletedAt == nil:
+			live = true
+		case v.DeletedAt.After(removedAt):
+			removedAt = *v.DeletedAt
+		}
+	}
+
+	return identityID
+}
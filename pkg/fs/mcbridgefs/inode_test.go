@@ -0,0 +1,34 @@
+package mcbridgefs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileIdentityID(t *testing.T) {
+	start := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	deletedAt := func(minutes int) *time.Time { d := at(minutes); return &d }
+
+	// The identity is the first version
+	versions := []fileVersionRow{
+		{ID: 1, CreatedAt: at(0)},
+		{ID: 5, CreatedAt: at(1)},
+	}
+	require.Equal(t, 1, fileIdentityID(versions))
+
+	// Removing the first version doesn't change the identity
+	versions[0].DeletedAt = deletedAt(2)
+	require.Equal(t, 1, fileIdentityID(versions))
+
+	// A file deleted and created again is a different file
+	versions[1].DeletedAt = deletedAt(3)
+	versions = append(versions, fileVersionRow{ID: 9, CreatedAt: at(4)}, fileVersionRow{ID: 12, CreatedAt: at(5)})
+	require.Equal(t, 9, fileIdentityID(versions))
+
+	// Which keeps its identity as its own first version is removed
+	versions[2].DeletedAt = deletedAt(6)
+	require.Equal(t, 9, fileIdentityID(versions))
+}
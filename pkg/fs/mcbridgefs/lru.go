@@ -0,0 +1,116 @@
+package mcbridgefs
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is the cache the bridge caches are built on. It holds at most size entries, evicting the
+// least recently used entries once it's full. When ttl is set, entries also expire ttl after they
+// were stored. It's safe for concurrent use.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[interface{}]*list.Element
+	lru     *list.List
+}
+
+type lruEntry struct {
+	key     interface{}
+	value   interface{}
+	expires time.Time
+}
+
+// newLRUCache creates a new lruCache holding up to size entries. A ttl of zero means entries only
+// leave the cache when they are evicted or removed.
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[interface{}]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the value cached for key. ok is false when key isn't cached, or its entry has expired.
+func (c *lruCache) get(key interface{}) (value interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.removeElement(elem)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+// store caches value for key, replacing any existing entry.
+func (c *lruCache) store(key, value interface{}) {
+	if c.size <= 0 {
+		return
+	}
+
+	entry := &lruEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove removes the entries for keys.
+func (c *lruCache) remove(keys ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if elem, found := c.entries[key]; found {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// removeIf removes the entries whose key matches.
+func (c *lruCache) removeIf(match func(key interface{}) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if match(key) {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// len returns the number of entries in the cache, including any that have expired but haven't
+// been read since.
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *lruCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*lruEntry).key)
+}
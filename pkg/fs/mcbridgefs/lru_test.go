@@ -0,0 +1,81 @@
+package mcbridgefs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache(2, 0)
+	c.store(1, "a")
+	c.store(2, "b")
+
+	// Reading 1 makes 2 the least recently used
+	_, ok := c.get(1)
+	require.True(t, ok)
+
+	c.store(3, "c")
+
+	_, ok = c.get(2)
+	require.False(t, ok, "Least recently used entry should be evicted")
+
+	value, ok := c.get(1)
+	require.True(t, ok, "Recently used entry should be kept")
+	require.Equal(t, "a", value)
+	require.Equal(t, 2, c.len())
+}
+
+func TestLRUCacheStoreReplaces(t *testing.T) {
+	c := newLRUCache(2, 0)
+	c.store(1, "a")
+	c.store(2, "b")
+	c.store(1, "c")
+
+	// Replacing 1 makes 2 the least recently used
+	c.store(3, "d")
+
+	value, ok := c.get(1)
+	require.True(t, ok)
+	require.Equal(t, "c", value)
+
+	_, ok = c.get(2)
+	require.False(t, ok, "Least recently used entry should be evicted")
+}
+
+func TestLRUCacheExpires(t *testing.T) {
+	c := newLRUCache(10, 10*time.Millisecond)
+	c.store(1, "a")
+	time.Sleep(20 * time.Millisecond)
+
+	_, ok := c.get(1)
+	require.False(t, ok, "Expired entry should not be returned")
+	require.Equal(t, 0, c.len(), "Expired entry should be removed when read")
+}
+
+func TestLRUCacheRemove(t *testing.T) {
+	c := newLRUCache(10, 0)
+	c.store("/a", 1)
+	c.store("/a/b", 2)
+	c.store("/c", 3)
+
+	c.remove("/c", "/missing")
+	_, ok := c.get("/c")
+	require.False(t, ok, "Removed entry should not be returned")
+
+	c.removeIf(func(key interface{}) bool { return key.(string) == "/a/b" })
+	_, ok = c.get("/a/b")
+	require.False(t, ok, "Matching entry should be removed")
+
+	_, ok = c.get("/a")
+	require.True(t, ok, "Entries that don't match should be kept")
+}
+
+func TestLRUCacheDisabled(t *testing.T) {
+	c := newLRUCache(0, 0)
+	c.store(1, "a")
+
+	_, ok := c.get(1)
+	require.False(t, ok, "A zero size should turn off caching")
+}
@@ -2,14 +2,14 @@ package mcbridgefs
 
 import (
 	"context"
-	"fmt"
-	"hash/fnv"
+	"errors"
 	"mime"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,11 +19,17 @@ import (
 	"github.com/materials-commons/gomcdb/mcmodel"
 	"github.com/materials-commons/gomcdb/store"
 	"github.com/materials-commons/mcbridgefs/pkg/fs/bridgefs"
+	"golang.org/x/sys/unix"
 	"gorm.io/gorm"
 )
 
 type Node struct {
 	file *mcmodel.File
+
+	// unlinked is set to 1 when the file was removed while it may still have been open. It prevents
+	// Release from marking a removed file as the current version. It's read and written from
+	// different requests, so it must only be accessed through setUnlinked and isUnlinked.
+	unlinked uint32
 	*bridgefs.BridgeNode
 }
 
@@ -33,6 +39,15 @@ var (
 	db                       *gorm.DB
 	transferRequest          mcmodel.TransferRequest
 	openedFilesTracker       *OpenFilesTracker
+	createdFilesTracker      *CreatedFilesTracker
+	attrCache                *AttrCache
+	readdirPageSize          int
+	pathCache                *PathCache
+	checksumDigests          *DigestCache
+	uploadResumer            *UploadResumer
+	releaseJournal           *ReleaseJournal
+	dedupStats               *dedupCounter
+	policy                   bridgePolicy
 	txRetryCount             int
 	fileStore                store.FileStore
 	transferRequestFileStore store.TransferRequestFileStore
@@ -64,12 +79,93 @@ func init() {
 	// Track any files that this instance writes to/create, so that if another instance does the same
 	// each of them will see their versions of the file, rather than intermixing them.
 	openedFilesTracker = NewOpenFilesTracker()
+
+	// Track the files and directories created during this transfer request. These can always be
+	// removed, while existing files can only be removed when the policy allows it.
+	createdFilesTracker = NewCreatedFilesTracker()
+
+	policy = loadPolicyFromEnv()
+
+	// Attributes are cached so that each stat doesn't need a database query. MC_ATTR_CACHE_SIZE bounds
+	// the number of cached entries, and MC_ATTR_CACHE_TTL is a duration such as "5s". Setting the TTL
+	// to "0" turns off the cache.
+	attrCacheSize64, err := strconv.ParseInt(os.Getenv("MC_ATTR_CACHE_SIZE"), 10, 32)
+	if err != nil || attrCacheSize64 < 0 {
+		attrCacheSize64 = 100000
+	}
+
+	attrCacheTTL, err := time.ParseDuration(os.Getenv("MC_ATTR_CACHE_TTL"))
+	if err != nil || attrCacheTTL < 0 {
+		attrCacheTTL = 5 * time.Second
+	}
+
+	attrCache = NewAttrCache(int(attrCacheSize64), attrCacheTTL)
+
+	// Directories are listed a page at a time. MC_READDIR_PAGE_SIZE sets how many entries are read in
+	// each query.
+	readdirPageSize64, err := strconv.ParseInt(os.Getenv("MC_READDIR_PAGE_SIZE"), 10, 32)
+	if err != nil || readdirPageSize64 < 1 {
+		readdirPageSize64 = 1000
+	}
+
+	readdirPageSize = int(readdirPageSize64)
+
+	// Directory paths are cached so that resolving a path doesn't query for its parent directories
+	// each time. MC_PATH_CACHE_SIZE bounds the number of cached paths, and MC_PATH_CACHE_TTL is a
+	// duration such as "30s" for how long they are cached.
+	pathCacheSize64, err := strconv.ParseInt(os.Getenv("MC_PATH_CACHE_SIZE"), 10, 32)
+	if err != nil || pathCacheSize64 < 0 {
+		pathCacheSize64 = 10000
+	}
+
+	pathCacheTTL, err := time.ParseDuration(os.Getenv("MC_PATH_CACHE_TTL"))
+	if err != nil || pathCacheTTL < 0 {
+		pathCacheTTL = 30 * time.Second
+	}
+
+	pathCache = NewPathCache(int(pathCacheSize64), pathCacheTTL)
+
+	// The digests computed when files are released are cached so they can be read through the mount.
+	// MC_DIGEST_CACHE_SIZE bounds the number of files whose digests are cached.
+	digestCacheSize64, err := strconv.ParseInt(os.Getenv("MC_DIGEST_CACHE_SIZE"), 10, 32)
+	if err != nil || digestCacheSize64 < 0 {
+		digestCacheSize64 = 10000
+	}
+
+	checksumDigests = NewDigestCache(int(digestCacheSize64))
+
+	// The state of the versions being written is checkpointed to MC_UPLOAD_STATE_DIR every
+	// MC_UPLOAD_CHECKPOINT_INTERVAL, so that uploads can be resumed if the bridge is restarted.
+	// Versions that aren't resumed within MC_UPLOAD_RESUME_TIMEOUT are removed. Setting the
+	// interval to "0" turns off resuming uploads. The state has to survive the machine rebooting,
+	// so it defaults to a directory in MCFS_DIR rather than a temporary one.
+	uploadStateDir := os.Getenv("MC_UPLOAD_STATE_DIR")
+	if uploadStateDir == "" && os.Getenv("MCFS_DIR") != "" {
+		uploadStateDir = filepath.Join(os.Getenv("MCFS_DIR"), ".mcbridgefs-state")
+	}
+
+	uploadCheckpointInterval, err := time.ParseDuration(os.Getenv("MC_UPLOAD_CHECKPOINT_INTERVAL"))
+	if err != nil || uploadCheckpointInterval < 0 {
+		uploadCheckpointInterval = 10 * time.Second
+	}
+
+	uploadResumeTimeout, err := time.ParseDuration(os.Getenv("MC_UPLOAD_RESUME_TIMEOUT"))
+	if err != nil || uploadResumeTimeout <= 0 {
+		uploadResumeTimeout = 24 * time.Hour
+	}
+
+	uploadResumer = NewUploadResumer(uploadStateDir, uploadCheckpointInterval, uploadResumeTimeout)
+
+	// Releases are journaled alongside the upload state, so that the ones that didn't finish can be
+	// recovered when the bridge is started again.
+	releaseJournal = NewReleaseJournal(uploadStateDir)
 }
 
 func CreateFS(fsRoot string, dB *gorm.DB, tr mcmodel.TransferRequest) *Node {
 	mcfsRoot = fsRoot
 	db = dB
 	transferRequest = tr
+	dedupStats = newDedupCounter(tr.ID)
 	fileStore = store.NewGormFileStore(db, fsRoot)
 	conversionStore = store.NewGormConversionStore(db)
 	transferRequestFileStore = store.NewGormTransferRequestFileStore(db)
@@ -93,42 +189,25 @@ func (n *Node) newNode() *Node {
 	}
 }
 
-// Readdir reads the corresponding directory and returns its entries
-func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	// Directories can have a large amount of files. To speed up processing
-	// Readdir uses queries that don't retrieve either the underlying directory
-	// for a mcmodel.File, or the underlying file for a mcmodel.TransferRequestFile.
-	// However, the path for the directory is still needed. This is accessed
-	// off of the underlying mcmodel.File by the FullPath() routine which is
-	// used the inodeHash() and getMode() methods. To work around this we
-	// create a single directory (see dirToUse below), and assign this as the
-	// directory for all mcmodel.File entries.
-	dirPath := filepath.Join("/", n.Path(n.Root()))
-	dirToUse := &mcmodel.File{Path: dirPath}
+// setUnlinked records that the file was removed.
+func (n *Node) setUnlinked() {
+	atomic.StoreUint32(&n.unlinked, 1)
+}
 
-	dir, err := n.getMCDir("")
-	if err != nil {
-		return nil, syscall.ENOENT
-	}
+// isUnlinked returns true when the file was removed.
+func (n *Node) isUnlinked() bool {
+	return atomic.LoadUint32(&n.unlinked) == 1
+}
 
-	files, err := transferRequestStore.ListDirectory(dir, transferRequest)
+// Readdir returns a stream that pages through the entries in the directory, so that large directories
+// don't have to be loaded all at once.
+func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	dir, err := n.getMCDir("")
 	if err != nil {
 		return nil, syscall.ENOENT
 	}
 
-	filesList := make([]fuse.DirEntry, 0, len(files))
-	for _, f := range files {
-		f.Directory = dirToUse
-		entry := fuse.DirEntry{
-			Mode: n.getMode(&f),
-			Name: f.Name,
-			Ino:  n.inodeHash(&f),
-		}
-
-		filesList = append(filesList, entry)
-	}
-
-	return fs.NewListDirStream(filesList), fs.OK
+	return newMCDirStream(dir, filepath.Join("/", n.Path(n.Root())), readdirPageSize), fs.OK
 }
 
 // Opendir just returns success
@@ -136,33 +215,65 @@ func (n *Node) Opendir(ctx context.Context) syscall.Errno {
 	return fs.OK
 }
 
-// Getxattr returns extra attributes. This is used by lstat. There are no extra attributes to
-// return so we always return a 0 for buffer length and success.
-func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
-	//fmt.Println("Getxattr")
-	return 0, fs.OK
-}
-
-// Getattr gets attributes about the file
+// Getattr gets attributes about the file. Files that this bridge is writing to report the attributes
+// of the version being written. Everything else is served from the attribute cache when possible.
 func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	//fmt.Println("Getattr:", n.Path(n.Root()), n.IsDir())
+	path := filepath.Join("/", n.Path(n.Root()))
+	ino := n.StableAttr().Ino
 
-	// Owner is always the process the bridge is running as
-	out.Uid = uid
-	out.Gid = gid
+	if !n.IsDir() {
+		if inProgress := getFromOpenedFiles(path); inProgress != nil {
+			return getFileAttr(inProgress, ino, &out.Attr)
+		}
+	}
 
-	if n.IsDir() {
-		now := time.Now()
-		out.SetTimes(&now, &now, &now)
+	if attr, ok := attrCache.Get(ino); ok {
+		out.Attr = attr
 		return fs.OK
 	}
 
-	file, err := fileStore.GetFileByPath(transferRequest.ProjectID, filepath.Join("/", n.Path(n.Root())))
+	var (
+		entry *mcmodel.File
+		err   error
+	)
+
+	if n.IsDir() {
+		entry, err = n.getMCDir("")
+	} else {
+		entry, err = getEntryByPath(path)
+	}
+
 	if err != nil {
-		log.Errorf("Getattr: GetFileByPath failed (%s): %s\n", filepath.Join("/", n.Path(n.Root())), err)
+		log.Errorf("Getattr: failed looking up %s: %s\n", path, err)
 		return syscall.ENOENT
 	}
 
+	return getEntryAttr(path, entry, ino, &out.Attr)
+}
+
+// getEntryAttr fills out the attributes for entry, which is at path and has the inode number ino,
+// and caches them. Files that this bridge is writing to report the attributes of the version being
+// written.
+func getEntryAttr(path string, entry *mcmodel.File, ino uint64, out *fuse.Attr) syscall.Errno {
+	var errno syscall.Errno
+	switch inProgress := getFromOpenedFiles(path); {
+	case entry.IsDir():
+		errno = getDirAttr(entry, ino, out)
+	case inProgress != nil:
+		errno = getFileAttr(inProgress, ino, out)
+	default:
+		errno = getFileAttr(entry, ino, out)
+	}
+
+	if errno == fs.OK {
+		attrCache.Store(ino, *out)
+	}
+
+	return errno
+}
+
+// getFileAttr fills out the attributes for a file from its underlying file.
+func getFileAttr(file *mcmodel.File, ino uint64, out *fuse.Attr) syscall.Errno {
 	st := syscall.Stat_t{}
 	if err := syscall.Lstat(file.ToUnderlyingFilePath(mcfsRoot), &st); err != nil {
 		log.Errorf("Getattr: Lstat failed (%s): %s\n", file.ToUnderlyingFilePath(mcfsRoot), err)
@@ -170,137 +281,317 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	}
 
 	out.FromStat(&st)
+	out.Ino = ino
+
+	// The underlying file for a symlink holds its target, so its size is already the length of
+	// the target.
+	if isSymlink(file) {
+		out.Mode = syscall.S_IFLNK | 0777
+	}
+
+	// Owner is always the process the bridge is running as
+	out.Uid = uid
+	out.Gid = gid
+
+	return fs.OK
+}
+
+// getDirAttr fills out the attributes for a directory from its mcmodel.File entry. The size is the
+// number of entries in the directory, and the link count follows the POSIX convention of two plus
+// the number of subdirectories.
+func getDirAttr(dir *mcmodel.File, ino uint64, out *fuse.Attr) syscall.Errno {
+	entries, subdirs, err := getDirChildCounts(dir.ID)
+	if err != nil {
+		log.Errorf("Getattr: failed counting entries in %s: %s", dir.Path, err)
+		return syscall.EIO
+	}
+
+	out.Mode = 0755 | uint32(syscall.S_IFDIR)
+	out.Size = uint64(entries)
+	out.Nlink = uint32(2 + subdirs)
+	out.Ino = ino
+	out.Uid = uid
+	out.Gid = gid
+	out.SetTimes(&dir.UpdatedAt, &dir.UpdatedAt, &dir.UpdatedAt)
 
 	return fs.OK
 }
 
+// invalidateCaches removes the cached attributes and path for n, and for its children called names.
+func (n *Node) invalidateCaches(names ...string) {
+	dirPath := filepath.Join("/", n.Path(n.Root()))
+	attrCache.Invalidate(n.StableAttr().Ino)
+	pathCache.Invalidate(dirPath)
+	for _, name := range names {
+		pathCache.Invalidate(filepath.Join(dirPath, name))
+		if child := n.GetChild(name); child != nil {
+			attrCache.Invalidate(child.StableAttr().Ino)
+		}
+	}
+}
+
 // Lookup will return information about the current entry.
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if name == versionsDirName {
+		return n.lookupVersionsDir(ctx, out)
+	}
+
 	path := filepath.Join("/", n.Path(n.Root()), name)
-	f, err := fileStore.GetFileByPath(transferRequest.ProjectID, path)
+
+	// With READDIRPLUS each entry is looked up as the directory is listed, so use the entry from
+	// the listing when there is one.
+	if entry, ok := getReaddirEntry(path); ok {
+		f := *entry.file
+		if attr, ok := attrCache.Get(entry.stableAttr.Ino); ok {
+			out.Attr = attr
+		} else if errno := getEntryAttr(path, &f, entry.stableAttr.Ino, &out.Attr); errno != fs.OK {
+			return nil, errno
+		}
+
+		node := n.newNode()
+		node.file = &f
+		return n.newChildInode(ctx, node, entry.stableAttr), fs.OK
+	}
+
+	f, err := getEntryByPath(path)
 	if err != nil {
 		return nil, syscall.ENOENT
 	}
 
-	out.Uid = uid
-	out.Gid = gid
-	if f.IsFile() {
-		out.Size = f.Size
+	stableAttr := n.stableAttr(f)
+	if errno := getEntryAttr(path, f, stableAttr.Ino, &out.Attr); errno != fs.OK {
+		return nil, errno
 	}
 
-	now := time.Now()
-	out.SetTimes(&now, &f.UpdatedAt, &now)
-
 	node := n.newNode()
 	node.file = f
-	return n.NewInode(ctx, node, fs.StableAttr{Mode: n.getMode(f), Ino: n.inodeHash(f)}), fs.OK
+	return n.newChildInode(ctx, node, stableAttr), fs.OK
 }
 
-// getMCDir looks a directory up in the database.
+// getMCDir looks a directory up in the path cache or the database.
 func (n *Node) getMCDir(name string) (*mcmodel.File, error) {
 	path := filepath.Join("/", n.Path(n.Root()), name)
-	return fileStore.GetDirByPath(transferRequest.ProjectID, path)
+	return getDirByPath(path)
 }
 
 // Mkdir will create a new directory. If an attempt is made to create an existing directory then it will return
 // the existing directory rather than returning an error.
 func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if name == versionsDirName {
+		return nil, syscall.EEXIST
+	}
+
 	path := filepath.Join("/", n.Path(n.Root()), name)
 	parent, err := n.getMCDir("")
 	if err != nil {
 		return nil, syscall.EINVAL
 	}
 
+	// CreateDirectory returns the existing directory if there is one, so check beforehand to
+	// know if this directory is being created during the transfer request.
+	_, errExisting := n.getMCDir(name)
+
 	dir, err := fileStore.CreateDirectory(parent.ID, transferRequest.ProjectID, transferRequest.OwnerID, path, name)
 
 	if err != nil {
 		return nil, syscall.EINVAL
 	}
 
-	out.Uid = uid
-	out.Gid = gid
+	if errExisting != nil {
+		createdFilesTracker.Add(path)
+		touchParentDirs(parent.ID)
+		n.invalidateCaches(name)
+	}
 
-	now := time.Now()
-	out.SetTimes(&now, &now, &now)
+	pathCache.Store(path, dir)
+
+	stableAttr := n.stableAttr(dir)
+	if errno := getEntryAttr(path, dir, stableAttr.Ino, &out.Attr); errno != fs.OK {
+		return nil, errno
+	}
 
 	node := n.newNode()
 	node.file = dir
-	return n.NewInode(ctx, node, fs.StableAttr{Mode: n.getMode(dir), Ino: n.inodeHash(dir)}), fs.OK
+	return n.newChildInode(ctx, node, stableAttr), fs.OK
 }
 
+// Rmdir soft deletes an empty directory. When the bridge policy enables recursive removal, a
+// non-empty directory is also removed, along with everything under it, as long as every entry
+// in it was created during this transfer request.
 func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
-	fmt.Printf("Rmdir %s/%s\n", n.Path(n.Root()), name)
-	return syscall.EIO
+	path := filepath.Join("/", n.Path(n.Root()), name)
+
+	dir, err := n.getMCDir(name)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	err = withTxRetry(func(tx *gorm.DB) error {
+		empty, err := isDirEmpty(tx, dir)
+		if err != nil {
+			return err
+		}
+
+		if empty {
+			// The directory is empty, but it may still contain previous versions of files that
+			// were removed. These are removed along with the directory.
+			return softDeleteDirs(tx, dir.ID)
+		}
+
+		if !policy.recursiveRmdir || !createdFilesTracker.Has(path) {
+			return errDirNotEmpty
+		}
+
+		return softDeleteCreatedSubtree(tx, dir)
+	}, db, txRetryCount)
+
+	switch {
+	case errors.Is(err, errDirNotEmpty):
+		return syscall.ENOTEMPTY
+	case err != nil:
+		log.Errorf("Rmdir: failed removing directory %s: %s", path, err)
+		return syscall.EIO
+	}
+
+	// The versions being written below the directory were soft deleted with it, so their handles
+	// must not make them current when they are released.
+	for _, p := range openedFilesTracker.PathsUnder(path) {
+		openedFilesTracker.Delete(p)
+	}
+	createdFilesTracker.DeleteDir(path)
+	touchParentDirs(dir.DirectoryID)
+	n.invalidateCaches(name)
+	pathCache.InvalidateTree(path)
+
+	// The kernel holds the directory lock while Rmdir runs, so the entry is invalidated after
+	// we return.
+	go n.NotifyEntry(name)
+
+	return fs.OK
 }
 
 // Create will create a new file. At this point the file shouldn't exist. However, because multiple users could be
 // uploading files, there is a chance it does exist. If that happens then a new version of the file is created instead.
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	f, err := n.createNewMCFile(name)
-	if err != nil {
-		log.Errorf("Create - failed creating new file (%s): %s", name, err)
-		return nil, nil, 0, syscall.EIO
+	if name == versionsDirName {
+		return nil, nil, 0, syscall.EEXIST
 	}
 
 	path := filepath.Join("/", n.Path(n.Root()), name)
-	openedFilesTracker.Store(path, f)
 
-	flags = flags &^ syscall.O_APPEND
-	fd, err := syscall.Open(f.ToUnderlyingFilePath(mcfsRoot), int(flags)|os.O_CREATE, mode)
+	// Retried creates after the bridge was restarted resume the version the upload was writing to,
+	// rather than starting another version and leaving that one behind.
+	openFile, fd, err := resumeUpload(path, flags, mode)
 	if err != nil {
-		log.Errorf("    Create - syscall.Open failed:", err)
+		log.Errorf("Create - failed resuming upload (%s): %s", path, err)
 		return nil, nil, 0, syscall.EIO
 	}
 
+	var f *mcmodel.File
+	if openFile != nil {
+		f = openFile.File
+	} else {
+		if f, err = n.createNewMCFile(name, getMimeType(name)); err != nil {
+			log.Errorf("Create - failed creating new file (%s): %s", name, err)
+			return nil, nil, 0, syscall.EIO
+		}
+
+		if fd, err = syscall.Open(f.ToUnderlyingFilePath(mcfsRoot), int(flags)|os.O_CREATE, mode); err != nil {
+			log.Errorf("Create - syscall.Open failed (%s): %s", path, err)
+			deleteFileVersion(f)
+			return nil, nil, 0, syscall.EIO
+		}
+	}
+
 	statInfo := syscall.Stat_t{}
 	if err := syscall.Fstat(fd, &statInfo); err != nil {
-		// TODO - Remove newly created file version in db
 		_ = syscall.Close(fd)
+		if openFile != nil {
+			openedFilesTracker.Release(openFile)
+		} else {
+			deleteFileVersion(f)
+		}
 		return nil, nil, 0, fs.ToErrno(err)
 	}
 
+	// Only track the file once it exists on disk, so that a failed create doesn't leave the tracker
+	// pointing at a version that was removed.
+	if openFile == nil {
+		openFile = openedFilesTracker.Store(path, f)
+	}
+	createdFilesTracker.Add(path)
+	touchParentDirs(f.DirectoryID)
+
+	stableAttr := n.stableAttr(f)
+	out.FromStat(&statInfo)
+	out.Ino = stableAttr.Ino
+	out.Uid = uid
+	out.Gid = gid
+	n.invalidateCaches(name)
+	attrCache.Store(stableAttr.Ino, out.Attr)
+
 	node := n.newNode()
 	node.file = f
-	out.FromStat(&statInfo)
-	return n.NewInode(ctx, node, fs.StableAttr{Mode: n.getMode(f), Ino: n.inodeHash(f)}), NewFileHandle(fd, flags, path), 0, fs.OK
+	return n.newChildInode(ctx, node, stableAttr), NewFileHandle(fd, flags, path, openFile), 0, fs.OK
 }
 
 // Open will open an existing file.
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	var (
-		err     error
-		newFile *mcmodel.File
+		err      error
+		newFile  *mcmodel.File
+		openFile *OpenFile
 	)
 	path := filepath.Join("/", n.Path(n.Root()))
 
+	// createdVersion is set when this call created the version being written to, so that it can be
+	// removed again if the open fails.
+	createdVersion := false
+
 	switch flags & syscall.O_ACCMODE {
 	case syscall.O_RDONLY:
-		newFile = getFromOpenedFiles(path)
-	case syscall.O_WRONLY:
-		newFile = getFromOpenedFiles(path)
-		if newFile == nil {
-			newFile, err = n.createNewMCFileVersion()
-			if err != nil {
-				// TODO: What error should be returned?
-				return nil, 0, syscall.EIO
+		// Read the version being written, or else the current version. The version the node was
+		// looked up with may have been replaced, or deduplicated, since.
+		if newFile = getFromOpenedFiles(path); newFile == nil {
+			if current, err := getEntryByPath(path); err == nil {
+				newFile = current
 			}
-
-			openedFilesTracker.Store(path, newFile)
 		}
-		flags = flags &^ syscall.O_CREAT
-		flags = flags &^ syscall.O_APPEND
-	case syscall.O_RDWR:
-		newFile = getFromOpenedFiles(path)
-		if newFile == nil {
+	case syscall.O_WRONLY, syscall.O_RDWR:
+		// Write handles hold a reference to the version being written to, which is finalized when
+		// the last of them is released.
+		// A version left by the bridge running earlier for this transfer request is resumed.
+		if openFile = openedFilesTracker.Acquire(path); openFile == nil {
+			openFile = uploadResumer.Resume(path)
+		}
+
+		if openFile == nil {
 			newFile, err = n.createNewMCFileVersion()
 			if err != nil {
 				// TODO: What error should be returned?
 				return nil, 0, syscall.EIO
 			}
-			openedFilesTracker.Store(path, newFile)
+			createdVersion = true
+
+			// A new version starts out with the contents of the current version, so that appends and
+			// in place updates work, unless it's about to be truncated anyway.
+			if flags&syscall.O_TRUNC == 0 {
+				if err := n.copyCurrentVersion(path, newFile); err != nil {
+					log.Errorf("Open: failed copying current version of %s: %s", path, err)
+					deleteFileVersion(newFile)
+					return nil, 0, syscall.EIO
+				}
+			}
+
+			openFile = openedFilesTracker.Store(path, newFile)
+		}
+
+		if flags&syscall.O_TRUNC != 0 {
+			openFile.recordTruncate(0)
 		}
+
+		newFile = openFile.File
 		flags = flags &^ syscall.O_CREAT
-		flags = flags &^ syscall.O_APPEND
 	default:
 		return
 	}
@@ -311,28 +602,144 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	}
 	fd, err := syscall.Open(filePath, int(flags), 0)
 	if err != nil {
+		switch {
+		case createdVersion:
+			openedFilesTracker.Release(openFile)
+			deleteFileVersion(newFile)
+		case openFile != nil:
+			// Other handles may have been released while this one was being opened, in which case
+			// this was the last reference and the version still has to be finalized.
+			n.releaseVersion(openFile)
+		}
 		return nil, 0, fs.ToErrno(err)
 	}
 
-	fhandle := NewFileHandle(fd, flags, path)
+	fhandle := NewFileHandle(fd, flags, path, openFile)
 	return fhandle, 0, fs.OK
 }
 
-// Setattr will set attributes on a file. Currently the only attribute supported is setting the size. This is
-// done by calling Ftruncate.
+// copyCurrentVersion copies the contents of the current version of the file at path into the new
+// version newFile.
+func (n *Node) copyCurrentVersion(path string, newFile *mcmodel.File) error {
+	current := n.file
+	if f, err := getEntryByPath(path); err == nil {
+		current = f
+	}
+
+	return copyFileContents(newFile.ToUnderlyingFilePath(mcfsRoot), current.ToUnderlyingFilePath(mcfsRoot))
+}
+
+// Setattr will set attributes on a file. The size is set by calling Ftruncate. The mode and the access and
+// modification times are set on the underlying file for the version being written, or the current version
+// when the file isn't being written, so that later calls to Getattr return them. The current version is
+// left alone when its contents are shared with other files, as the change would show up on all of them.
+// The permissions that can be set are limited by the bridge policy. Ownership isn't changed as everything
+// is owned by the bridge.
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if n.IsDir() {
+		return n.setDirAttr(ctx, in, out)
+	}
+
 	if sz, ok := in.GetSize(); ok {
 		fh, ok := f.(*FileHandle)
 		if !ok {
 			// For now lets return fs.OK, because there doesn't seem to be anything here
 			return fs.OK
 		}
-		return fs.ToErrno(syscall.Ftruncate(fh.Fd, int64(sz)))
+
+		if fh.openFile != nil {
+			fh.openFile.recordTruncate(int64(sz))
+		}
+
+		if err := syscall.Ftruncate(fh.Fd, int64(sz)); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	path := filepath.Join("/", n.Path(n.Root()))
+	file := getFromOpenedFiles(path)
+	if file == nil {
+		var err error
+		if file, err = getEntryByPath(path); err != nil {
+			return syscall.ENOENT
+		}
+
+		if shared, err := sharesBlob(file); err != nil || shared {
+			log.Infof("Setattr: not changing mode or times of %s, its contents are shared", path)
+			return n.setattrResult(file, out)
+		}
 	}
 
+	underlyingPath := file.ToUnderlyingFilePath(mcfsRoot)
+
+	// The permissions of a symlink are meaningless, so they are never changed.
+	if mode, ok := in.GetMode(); ok && !isSymlink(file) {
+		if err := syscall.Chmod(underlyingPath, policy.fileMode(mode)); err != nil {
+			log.Errorf("Setattr: Chmod failed (%s): %s", underlyingPath, err)
+			return fs.ToErrno(err)
+		}
+	}
+
+	if atime, mtime, ok := getSetattrTimes(in); ok {
+		ts := []syscall.Timespec{fuse.UtimeToTimespec(atime), fuse.UtimeToTimespec(mtime)}
+		if err := syscall.UtimesNano(underlyingPath, ts); err != nil {
+			log.Errorf("Setattr: UtimesNano failed (%s): %s", underlyingPath, err)
+			return fs.ToErrno(err)
+		}
+	}
+
+	return n.setattrResult(file, out)
+}
+
+// setattrResult fills out the attributes of file after a Setattr, and caches them.
+func (n *Node) setattrResult(file *mcmodel.File, out *fuse.AttrOut) syscall.Errno {
+	if errno := getFileAttr(file, n.StableAttr().Ino, &out.Attr); errno != fs.OK {
+		return errno
+	}
+
+	attrCache.Store(out.Ino, out.Attr)
+
 	return fs.OK
 }
 
+// setDirAttr handles Setattr for a directory. Only the modification time is kept, as the updated_at
+// time of the directory, which is what Getattr reports.
+func (n *Node) setDirAttr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if _, mtime, ok := getSetattrTimes(in); ok && mtime != nil {
+		dir, err := n.getMCDir("")
+		if err != nil {
+			return syscall.ENOENT
+		}
+
+		err = withTxRetry(func(tx *gorm.DB) error {
+			return tx.Model(&mcmodel.File{}).Where("id = ?", dir.ID).UpdateColumn("updated_at", *mtime).Error
+		}, db, txRetryCount)
+
+		if err != nil {
+			log.Errorf("Setattr: failed setting modification time for %s: %s", dir.Path, err)
+			return syscall.EIO
+		}
+
+		n.invalidateCaches()
+	}
+
+	return n.Getattr(ctx, nil, out)
+}
+
+// getSetattrTimes returns the access and modification times to set. A time that isn't being set
+// is nil. ok is false when neither time is being set.
+func getSetattrTimes(in *fuse.SetAttrIn) (atime, mtime *time.Time, ok bool) {
+	if t, set := in.GetATime(); set {
+		atime = &t
+	}
+
+	if t, set := in.GetMTime(); set {
+		mtime = &t
+	}
+
+	return atime, mtime, atime != nil || mtime != nil
+}
+
 // Release will close the file handle and update meta data about the file in the database
 func (n *Node) Release(ctx context.Context, f fs.FileHandle) syscall.Errno {
 	bridgeFH, ok := f.(fs.FileReleaser)
@@ -345,52 +752,122 @@ func (n *Node) Release(ctx context.Context, f fs.FileHandle) syscall.Errno {
 		return err
 	}
 
-	// If the file was opened only for read then there is no meta data that needs to be updated.
+	// If the file was opened only for read then there is no meta data that needs to be updated. Only
+	// handles that can write to the file hold a reference to the version being written.
 	fh := bridgeFH.(*FileHandle)
-	if fh.Flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+	nf := fh.openFile
+	if nf == nil || nf.File == nil {
 		return fs.OK
 	}
 
-	// If we are here then the file was opened with a write flag. In this case we need to update the
-	// file size, set this as the current file, and if a new checksum was computed, set the checksum.
-	fileToUpdate := n.file
-	fpath := filepath.Join("/", n.Path(n.Root()))
-	nf := openedFilesTracker.Get(fpath)
-	if nf != nil && nf.File != nil {
-		fileToUpdate = nf.File
+	return n.releaseVersion(nf)
+}
+
+// releaseVersion gives up a reference to the version nf. The version is finalized once the last
+// reference to it is released. When versions are continued, finalizing is delayed for the reopen
+// grace period, so that opening the file for write again in that time continues the version rather
+// than reopening one that has already been released. The release is journaled straight away so
+// that it's still finished if the bridge dies during the grace period.
+func (n *Node) releaseVersion(nf *OpenFile) syscall.Errno {
+	if policy.reopenPolicy != reopenContinueVersion {
+		if !openedFilesTracker.Release(nf) {
+			return fs.OK
+		}
+
+		return n.finalizeVersion(nf, openedFilesTracker.PathOf(nf))
 	}
 
-	var (
-		size  uint64
-		attrs fuse.AttrOut
-	)
+	finalize := func(path string) {
+		_ = n.finalizeVersion(nf, path)
+	}
 
-	fhGetAttr, ok := f.(fs.FileGetattrer)
-	if !ok {
-		size = 0
+	if openedFilesTracker.ReleaseAfter(nf, policy.reopenGrace, finalize) && !openedFilesTracker.IsRemoved(nf) {
+		releaseJournal.Pending(nf.File, openedFilesTracker.PathOf(nf), "", 0)
+	}
+
+	return fs.OK
+}
+
+// finalizeVersion updates the meta data for the version nf at fpath once it's no longer being written,
+// and makes it the current version.
+func (n *Node) finalizeVersion(nf *OpenFile, fpath string) syscall.Errno {
+	fileToUpdate := nf.File
+
+	// If the file was removed or replaced while it was open then it has already been soft deleted,
+	// and it must not be marked as the current version.
+	if n.isUnlinked() || openedFilesTracker.IsRemoved(nf) {
+		abandonRelease(fileToUpdate)
+		return fs.OK
 	}
 
-	if err := fhGetAttr.Getattr(ctx, &attrs); err == fs.OK {
-		size = attrs.Size
+	// The handles writing to the version are closed, so the size is taken from the underlying file.
+	var size uint64
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(fileToUpdate.ToUnderlyingFilePath(mcfsRoot), &st); err == nil {
+		size = uint64(st.Size)
 	}
 
+	// The digest for the primary algorithm is stored as the file checksum. All the digests are
+	// kept so that they can be read through the mount.
 	var checksum string
-	if nf != nil {
-		checksum = fmt.Sprintf("%x", nf.hasher.Sum(nil))
+	digests, err := nf.computeDigests(fileToUpdate.ToUnderlyingFilePath(mcfsRoot), int64(size))
+	if err != nil {
+		log.Errorf("Release: failed computing checksum for %s: %s", fpath, err)
+	} else {
+		primary := nf.hasher.algorithms[0]
+		checksum = formatChecksum(primary, digests[primary])
+		checksumDigests.Store(fileToUpdate.ID, digests)
+	}
+
+	// Syncing a folder again rewrites files that haven't changed. Rather than adding a version that is
+	// identical to the current one, the new version is discarded and the current version is kept.
+	if current, err := getEntryByPath(fpath); err == nil && isUnchangedVersion(current, fileToUpdate, checksum, size) {
+		deleteFileVersion(fileToUpdate)
+		abandonRelease(fileToUpdate)
+		n.invalidateCaches()
+		return fs.OK
 	}
 
+	// The release is journaled before updating the database, so that if an update fails or the bridge
+	// dies part way through, the release is finished by the recovery pass when the bridge next starts.
+	releaseJournal.Pending(fileToUpdate, fpath, checksum, int64(size))
+
 	errno := fs.ToErrno(transferRequestStore.MarkFileReleased(fileToUpdate, checksum, transferRequest.ProjectID, int64(size)))
+	if errno != fs.OK {
+		log.Errorf("Release: failed marking %s as released, it will be retried", fpath)
+		releaseJournal.RetryLater(fileToUpdate, fpath, checksum, int64(size), journalPending)
+		n.invalidateCaches()
+		return errno
+	}
+
+	releaseJournal.Released(fileToUpdate)
+	dedupFileVersion(fileToUpdate, checksum, int64(size))
+	n.invalidateCaches()
 
 	// Add to convertible list after marking as released to prevent the condition where the
 	// file hasn't been released but is picked up for conversion. This is a very unlikely
 	// case, but easy to prevent by releasing then adding to conversions list.
 	if fileToUpdate.IsConvertible() {
 		if _, err := conversionStore.AddFileToConvert(fileToUpdate); err != nil {
-			log.Errorf("Failed adding file to conversion: %d", fileToUpdate.ID)
+			log.Errorf("Failed adding file to conversion: %d, it will be retried", fileToUpdate.ID)
+			releaseJournal.RetryLater(fileToUpdate, fpath, checksum, int64(size), journalReleased)
+			return fs.OK
 		}
+
+		releaseJournal.Queued(fileToUpdate)
 	}
 
-	return errno
+	releaseJournal.Done(fileToUpdate)
+
+	return fs.OK
+}
+
+// abandonRelease is called when the version f won't be released. Its release was already journaled
+// when versions are continued, so that entry is closed off.
+func abandonRelease(f *mcmodel.File) {
+	if policy.reopenPolicy == reopenContinueVersion {
+		releaseJournal.Done(f)
+	}
 }
 
 // createNewMCFileVersion creates a new file version if there isn't already a version of the file
@@ -406,6 +883,15 @@ func (n *Node) createNewMCFileVersion() (*mcmodel.File, error) {
 		return existing, nil
 	}
 
+	// The node's file may have been loaded without its directory.
+	dir := n.file.Directory
+	if dir == nil {
+		var err error
+		if dir, err = n.getMCDir(".."); err != nil {
+			return nil, err
+		}
+	}
+
 	var err error
 
 	// There isn't an existing upload, so create a new one
@@ -420,7 +906,7 @@ func (n *Node) createNewMCFileVersion() (*mcmodel.File, error) {
 		Current:     false,
 	}
 
-	newFile, err = transferRequestStore.CreateNewFile(newFile, n.file.Directory, transferRequest)
+	newFile, err = transferRequestStore.CreateNewFile(newFile, dir, transferRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -430,6 +916,7 @@ func (n *Node) createNewMCFileVersion() (*mcmodel.File, error) {
 
 	if err != nil {
 		log.Errorf("os.OpenFile failed (%s): %s\n", newFile.ToUnderlyingFilePath(mcfsRoot), err)
+		deleteFileVersion(newFile)
 		return nil, err
 	}
 	defer f.Close()
@@ -437,9 +924,9 @@ func (n *Node) createNewMCFileVersion() (*mcmodel.File, error) {
 	return newFile, nil
 }
 
-// createNewMCFile will create a new mcmodel.File entry for the directory associated
-// with the Node. It will create the directory where the file can be written to.
-func (n *Node) createNewMCFile(name string) (*mcmodel.File, error) {
+// createNewMCFile will create a new mcmodel.File entry with the given mime type for the directory
+// associated with the Node. It will create the directory where the file can be written to.
+func (n *Node) createNewMCFile(name, mimeType string) (*mcmodel.File, error) {
 	dir, err := n.getMCDir("")
 	if err != nil {
 		return nil, err
@@ -451,7 +938,7 @@ func (n *Node) createNewMCFile(name string) (*mcmodel.File, error) {
 		DirectoryID: dir.ID,
 		Size:        0,
 		Checksum:    "",
-		MimeType:    getMimeType(name),
+		MimeType:    mimeType,
 		OwnerID:     transferRequest.OwnerID,
 		Current:     false,
 	}
@@ -476,54 +963,342 @@ func getMimeType(name string) string {
 	return strings.TrimSpace(mimeType[:semicolon])
 }
 
+// Rename renames or moves a file or directory. Renames that exchange the source and destination
+// are not supported.
 func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
-	fmt.Printf("Rename: %s/%s to %s/%s\n", n.Path(n.Root()), name, newParent.EmbeddedInode().Path(n.Root()), newName)
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+
+	newParentNode, ok := newParent.(*Node)
+	if !ok {
+		return syscall.EINVAL
+	}
+
 	fromPath := filepath.Join("/", n.Path(n.Root()))
 	toPath := filepath.Join("/", newParent.EmbeddedInode().Path(n.Root()))
 
-	dir, err := n.getMCDir("")
+	fromDir, err := n.getMCDir("")
 	if err != nil {
 		return syscall.ENOENT
 	}
 
-	var f mcmodel.File
-	err = db.Preload("Directory").
-		Where("directory_id = ?", dir.ID).
-		Where("project_id = ?", transferRequest.ProjectID).
-		Where("name = ?", name).
-		Where("current = ?", true).
-		Where("deleted_at IS NULL").
-		Find(&f).Error
+	toDir := fromDir
+	if fromPath != toPath {
+		if toDir, err = newParentNode.getMCDir(""); err != nil {
+			return syscall.ENOENT
+		}
+	}
 
+	f, err := getEntryInDir(fromDir, name)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	var errno syscall.Errno
+	if f.IsDir() {
+		errno = n.renameDir(toDir, name, newName, flags, f)
+		pathCache.InvalidateTree(f.Path)
+	} else {
+		errno = n.renameFile(fromDir, toDir, name, newName, flags, f)
+	}
+
+	// Both directories, the renamed entry and any entry it replaces have changed.
+	n.invalidateCaches(name)
+	newParentNode.invalidateCaches(newName)
+
+	return errno
+}
+
+// renameDir renames or moves the directory f to toName in toDir. The path of every descendant
+// directory is rewritten to be under the new location. A directory can't be moved into its own
+// subtree. It replaces an existing directory at the destination only when that directory is empty,
+// and could be removed with Rmdir.
+func (n *Node) renameDir(toDir *mcmodel.File, name, toName string, flags uint32, f *mcmodel.File) syscall.Errno {
+	if toDir.ID == f.ID || strings.HasPrefix(toDir.Path+"/", f.Path+"/") {
+		return syscall.EINVAL
+	}
+
+	fromDirPath := f.Path
+	toDirPath := filepath.Join(toDir.Path, toName)
+
+	target, err := getCurrentEntryInDir(toDir.ID, toName)
 	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		return syscall.EIO
 	case err != nil:
-		return syscall.ENOENT
-	case f.IsDir():
-		return n.renameDir(fromPath, toPath, name, newName, f)
-	default:
-		// f is a file
-		return n.renameFile(fromPath, toPath, name, newName, f)
+		// Nothing exists at the destination
+		target = nil
+	case target.ID == f.ID:
+		// Renaming a directory onto itself
+		return fs.OK
+	case !target.IsDir():
+		return syscall.ENOTDIR
+	case flags&unix.RENAME_NOREPLACE != 0:
+		return syscall.EEXIST
 	}
+
+	err = withTxRetry(func(tx *gorm.DB) error {
+		if target != nil {
+			empty, err := isDirEmpty(tx, target)
+			switch {
+			case err != nil:
+				return err
+			case !empty:
+				return errDirNotEmpty
+			}
+
+			if err := softDeleteDirs(tx, target.ID); err != nil {
+				return err
+			}
+		}
+
+		err := tx.Model(&mcmodel.File{}).
+			Where("id = ?", f.ID).
+			Updates(map[string]interface{}{"name": toName, "path": toDirPath, "directory_id": toDir.ID}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := touchDirs(tx, f.DirectoryID, toDir.ID); err != nil {
+			return err
+		}
+
+		descendants, err := getDirectoriesToUpdate(tx, f, toDirPath)
+		if err != nil {
+			return err
+		}
+
+		for _, descendant := range descendants {
+			if err := tx.Model(&mcmodel.File{}).Where("id = ?", descendant.ID).Update("path", descendant.Path).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, db, txRetryCount)
+
+	switch {
+	case errors.Is(err, errDirNotEmpty):
+		return syscall.ENOTEMPTY
+	case err != nil:
+		log.Errorf("renameDir: failed renaming %s to %s: %s", fromDirPath, toDirPath, err)
+		return syscall.EIO
+	}
+
+	if target != nil {
+		createdFilesTracker.DeleteDir(toDirPath)
+		pathCache.InvalidateTree(toDirPath)
+	}
+
+	openedFilesTracker.MoveDir(fromDirPath, toDirPath)
+	createdFilesTracker.MoveDir(fromDirPath, toDirPath)
+
+	if child := n.GetChild(name); child != nil {
+		if childNode, ok := child.Operations().(*Node); ok && childNode.file != nil {
+			moveFile(childNode.file, toDir, toName)
+			childNode.file.Path = toDirPath
+		}
+		updateCachedPaths(child, toDirPath)
+	}
+
+	// The kernel holds the directory locks while Rename runs, so the old entry is invalidated
+	// after we return.
+	go n.NotifyEntry(name)
+
+	return fs.OK
 }
 
-func (n *Node) renameDir(fromPath, toPath, name, toName string, f mcmodel.File) syscall.Errno {
-	if fromPath == toPath {
-		// not being moved to another directory. Just rename directory and all descendant directory
-		// paths
+// renameFile moves a file, along with all of its previous versions, to toName in toDir. When there
+// is already a file called toName in toDir, the renamed file becomes the newest version of that
+// file rather than the rename failing.
+func (n *Node) renameFile(fromDir, toDir *mcmodel.File, name, toName string, flags uint32, f *mcmodel.File) syscall.Errno {
+	fromFilePath := filepath.Join(fromDir.Path, name)
+	toFilePath := filepath.Join(toDir.Path, toName)
+
+	target, err := getCurrentEntryInDir(toDir.ID, toName)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		return syscall.EIO
+	case err != nil:
+		// Nothing exists at the destination
+		target = nil
+	case target.IsDir():
+		return syscall.EISDIR
+	case flags&unix.RENAME_NOREPLACE != 0:
+		return syscall.EEXIST
+	case target.ID == f.ID:
+		// Renaming a file onto itself
+		return fs.OK
+	}
+
+	// A version being written to at the destination is replaced by the renamed file, so it's removed
+	// rather than being finalized on top of it.
+	var replaced *mcmodel.File
+	if fromFilePath != toFilePath {
+		replaced = getFromOpenedFiles(toFilePath)
+	}
+
+	err = withTxRetry(func(tx *gorm.DB) error {
+		var versionIDs []int
+		err := tx.Model(&mcmodel.File{}).
+			Where("directory_id = ?", fromDir.ID).
+			Where("project_id = ?", transferRequest.ProjectID).
+			Where("name = ?", name).
+			Where("mime_type <> ?", "directory").
+			Where("deleted_at IS NULL").
+			Pluck("id", &versionIDs).Error
+		if err != nil {
+			return err
+		}
+
+		if replaced != nil {
+			if err := softDeleteFiles(tx, replaced.ID); err != nil {
+				return err
+			}
+		}
+
+		if target != nil && f.Current {
+			// The renamed file replaces the target as the current version. The targets versions are
+			// left in place, so they become the previous versions of the renamed file. When only a
+			// version being written to is renamed, the target stays current until it's released.
+			if err := tx.Model(&mcmodel.File{}).Where("id = ?", target.ID).Update("current", false).Error; err != nil {
+				return err
+			}
+		}
+
+		err = tx.Model(&mcmodel.File{}).
+			Where("id in ?", versionIDs).
+			Updates(map[string]interface{}{"name": toName, "directory_id": toDir.ID}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := touchDirs(tx, fromDir.ID, toDir.ID); err != nil {
+			return err
+		}
+
+		return tx.Model(&mcmodel.TransferRequestFile{}).
+			Where("file_id in ?", versionIDs).
+			Updates(map[string]interface{}{"name": toName, "directory_id": toDir.ID}).Error
+	}, db, txRetryCount)
+
+	if err != nil {
+		log.Errorf("renameFile: failed renaming %s to %s: %s", fromFilePath, toFilePath, err)
+		return syscall.EIO
+	}
+
+	if replaced != nil {
+		openedFilesTracker.Delete(toFilePath)
+	}
+
+	// Any version being written to has to follow the rename, so that the release marks the right
+	// file as current and in-flight writes still find it.
+	if openFile := openedFilesTracker.Move(fromFilePath, toFilePath); openFile != nil && openFile.File != nil {
+		moveFile(openFile.File, toDir, toName)
 	}
-	return syscall.EPERM
+
+	if createdFilesTracker.Has(fromFilePath) {
+		createdFilesTracker.Delete(fromFilePath)
+		createdFilesTracker.Add(toFilePath)
+	}
+
+	if child := n.GetChild(name); child != nil {
+		if childNode, ok := child.Operations().(*Node); ok && childNode.file != nil {
+			moveFile(childNode.file, toDir, toName)
+		}
+	}
+
+	return fs.OK
 }
 
-func (n *Node) renameFile(fromPath, toPath, name, toName string, f mcmodel.File) syscall.Errno {
-	if fromPath == toPath {
-		// not being moved to another directory. Just rename file and all its previous versions
+// updateCachedPaths walks the inodes cached under inode, which is the directory at dirPath, and
+// updates the paths of their mcmodel.File entries after a directory rename.
+func updateCachedPaths(inode *fs.Inode, dirPath string) {
+	for name, child := range inode.Children() {
+		childNode, ok := child.Operations().(*Node)
+		if !ok || childNode.file == nil {
+			continue
+		}
+
+		if childNode.file.IsDir() {
+			childNode.file.Path = filepath.Join(dirPath, name)
+			updateCachedPaths(child, childNode.file.Path)
+		} else if childNode.file.Directory != nil {
+			childNode.file.Directory.Path = dirPath
+		}
 	}
-	return syscall.EPERM
 }
 
+// moveFile updates the in memory fields of f to reflect that it was renamed to name in dir.
+func moveFile(f *mcmodel.File, dir *mcmodel.File, name string) {
+	f.Name = name
+	f.DirectoryID = dir.ID
+	f.Directory = dir
+}
+
+// Unlink soft deletes a file, along with all of its versions. Files created during this transfer
+// request can always be removed. Files that existed before the transfer request was opened can
+// only be removed when the bridge policy allows it.
 func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
-	fmt.Printf("Unlink: %s/%s\n", n.Path(n.Root()), name)
-	return syscall.EPERM
+	path := filepath.Join("/", n.Path(n.Root()), name)
+
+	dir, err := n.getMCDir("")
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	f, err := getEntryInDir(dir, name)
+	switch {
+	case err != nil:
+		return syscall.ENOENT
+	case f.IsDir():
+		return syscall.EISDIR
+	case !createdFilesTracker.Has(path) && !policy.allowDeleteExisting:
+		return syscall.EPERM
+	}
+
+	// All the versions of the file are removed. Otherwise a previous version would still be listed
+	// under .versions, and a version being written to in this transfer request would become
+	// current on release.
+	err = withTxRetry(func(tx *gorm.DB) error {
+		if err := softDeleteFileVersions(tx, dir.ID, name); err != nil {
+			return err
+		}
+
+		return touchDirs(tx, dir.ID)
+	}, db, txRetryCount)
+
+	if err != nil {
+		log.Errorf("Unlink: failed deleting file (%s): %s", path, err)
+		return syscall.EIO
+	}
+
+	openedFilesTracker.Delete(path)
+	createdFilesTracker.Delete(path)
+	n.invalidateCaches(name)
+
+	if child := n.GetChild(name); child != nil {
+		if childNode, ok := child.Operations().(*Node); ok {
+			childNode.setUnlinked()
+		}
+	}
+
+	// The kernel holds the directory lock while Unlink runs, so the entry has to be invalidated
+	// after we return to avoid deadlocking on it.
+	go n.NotifyEntry(name)
+
+	return fs.OK
+}
+
+// isUnchangedVersion returns true when the new version, whose contents have the given checksum and
+// size, is identical to the current version of the file.
+func isUnchangedVersion(current, version *mcmodel.File, checksum string, size uint64) bool {
+	return checksum != "" &&
+		current.ID != version.ID &&
+		!current.IsDir() &&
+		current.Checksum == checksum &&
+		current.Size == size
 }
 
 // getMode returns the mode for the file. It checks if the underlying mcmodel.File is
@@ -537,18 +1312,11 @@ func (n *Node) getMode(entry *mcmodel.File) uint32 {
 		return 0755 | uint32(syscall.S_IFDIR)
 	}
 
-	return 0644 | uint32(syscall.S_IFREG)
-}
-
-// inodeHash creates a new inode id from the the file path.
-func (n *Node) inodeHash(entry *mcmodel.File) uint64 {
-	if entry == nil {
-		return 1
+	if isSymlink(entry) {
+		return 0777 | uint32(syscall.S_IFLNK)
 	}
 
-	h := fnv.New64a()
-	_, _ = h.Write([]byte(entry.FullPath()))
-	return h.Sum64()
+	return 0644 | uint32(syscall.S_IFREG)
 }
 
 // getFromOpenedFiles returns the mcmodel.File from the openedFilesTracker. It handles
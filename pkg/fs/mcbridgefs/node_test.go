@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-uuid"
+	"github.com/materials-commons/gomcdb/mcmodel"
 	"github.com/stretchr/testify/require"
 )
 
@@ -57,3 +58,14 @@ func TestFTruncateFile(t *testing.T) {
 	err = syscall.Close(fd)
 	require.NoError(t, err, "Close failed: %s", err)
 }
+
+func TestIsUnchangedVersion(t *testing.T) {
+	current := &mcmodel.File{ID: 1, Name: "data.csv", Checksum: "abc", Size: 10}
+	version := &mcmodel.File{ID: 2, Name: "data.csv"}
+
+	require.True(t, isUnchangedVersion(current, version, "abc", 10))
+	require.False(t, isUnchangedVersion(current, version, "abd", 10), "Different checksum")
+	require.False(t, isUnchangedVersion(current, version, "abc", 11), "Different size")
+	require.False(t, isUnchangedVersion(current, version, "", 10), "No checksum computed")
+	require.False(t, isUnchangedVersion(current, current, "abc", 10), "Version is already current")
+}
@@ -1,33 +1,187 @@
 package mcbridgefs
 
 import (
-	"crypto/md5"
-	"hash"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/materials-commons/gomcdb/mcmodel"
 )
 
+// OpenFilesTracker tracks the file versions this bridge is writing to, keyed by path. Each write
+// handle holds a reference to the entry for its path, and the entry is dropped when the last of them
+// is released. When the bridge policy is to continue versions, the entry is kept for a grace period
+// after the last release instead, so that reopening the file for write continues the same version
+// before it's finalized.
 type OpenFilesTracker struct {
 	m sync.Map
+
+	// mu protects the reference counts.
+	mu sync.Mutex
 }
 
 type OpenFile struct {
 	File     *mcmodel.File
 	Checksum string
-	hasher   hash.Hash
+	hasher   *multiHasher
+
+	// path is the path the entry is stored under, and refs is the number of handles holding it.
+	// removed is set when the version was deleted while handles still held it, so that releasing
+	// them doesn't make it current. They are protected by the OpenFilesTracker mu.
+	path    string
+	refs    int
+	removed bool
+
+	// finalizeTimer is set while the entry is waiting out the grace period after its last
+	// release, and finalize is called once it's over. They are protected by the OpenFilesTracker mu.
+	finalizeTimer *time.Timer
+	finalize      func(path string)
+
+	// The hasher is only correct when the file was written strictly sequentially from offset 0.
+	// sequential tracks if that is still the case and nextOffset is the offset the next write
+	// has to start at for it to remain sequential. mu protects these and the hasher, since a
+	// file can be written through several handles.
+	mu         sync.Mutex
+	sequential bool
+	nextOffset int64
 }
 
 func NewOpenFilesTracker() *OpenFilesTracker {
 	return &OpenFilesTracker{}
 }
 
-func (t *OpenFilesTracker) Store(path string, file *mcmodel.File) {
+// Store starts tracking file as the version being written to at path. The caller holds the first
+// reference to the entry, which it gives up by calling Release.
+func (t *OpenFilesTracker) Store(path string, file *mcmodel.File) *OpenFile {
 	openFile := &OpenFile{
-		File:   file,
-		hasher: md5.New(),
+		File:       file,
+		hasher:     newMultiHasher(policy.checksumAlgorithms),
+		sequential: true,
+		path:       path,
+		refs:       1,
 	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	t.m.Store(path, openFile)
+
+	return openFile
+}
+
+// Acquire takes a reference to the entry for path. It returns nil if path isn't being written to.
+func (t *OpenFilesTracker) Acquire(path string) *OpenFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	openFile := t.Get(path)
+	if openFile != nil {
+		// Reopening the file during the grace period continues the version.
+		if openFile.finalizeTimer != nil {
+			openFile.finalizeTimer.Stop()
+			openFile.finalizeTimer = nil
+			openFile.finalize = nil
+		}
+		openFile.refs++
+	}
+
+	return openFile
+}
+
+// Release gives up a reference to openFile. It returns true when this was the last reference, in
+// which case the entry is no longer tracked and the caller should finalize the version.
+func (t *OpenFilesTracker) Release(openFile *OpenFile) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	openFile.refs--
+	if openFile.refs > 0 {
+		return false
+	}
+
+	if t.Get(openFile.path) == openFile {
+		t.m.Delete(openFile.path)
+	}
+
+	return true
+}
+
+// ReleaseAfter gives up a reference to openFile like Release, except that when it's the last
+// reference the entry stays tracked for grace, so that opening the file for write again continues
+// the version. If the grace period passes without that happening, the entry is dropped and
+// finalize is called with the path it was at. It returns true when finalizing was scheduled.
+func (t *OpenFilesTracker) ReleaseAfter(openFile *OpenFile, grace time.Duration, finalize func(path string)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	openFile.refs--
+	if openFile.refs > 0 {
+		return false
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		t.mu.Lock()
+		if openFile.finalizeTimer != timer {
+			// The file was reopened, or it's being finalized by FinalizePending
+			t.mu.Unlock()
+			return
+		}
+
+		path := t.dropPending(openFile)
+		t.mu.Unlock()
+
+		finalize(path)
+	})
+	openFile.finalizeTimer = timer
+	openFile.finalize = finalize
+
+	return true
+}
+
+// FinalizePending finalizes the entries waiting out their grace period right away, and returns
+// once they are done. It's used when the bridge is stopping.
+func (t *OpenFilesTracker) FinalizePending() {
+	type pendingFinalize struct {
+		path     string
+		finalize func(path string)
+	}
+
+	var pending []pendingFinalize
+
+	t.mu.Lock()
+	t.m.Range(func(key, value interface{}) bool {
+		if openFile := value.(*OpenFile); openFile.finalizeTimer != nil {
+			openFile.finalizeTimer.Stop()
+			finalize := openFile.finalize
+			pending = append(pending, pendingFinalize{path: t.dropPending(openFile), finalize: finalize})
+		}
+		return true
+	})
+	t.mu.Unlock()
+
+	for _, p := range pending {
+		p.finalize(p.path)
+	}
+}
+
+// dropPending stops tracking openFile once its grace period is over, and returns the path it was
+// at. t.mu must be held.
+func (t *OpenFilesTracker) dropPending(openFile *OpenFile) string {
+	openFile.finalizeTimer = nil
+	openFile.finalize = nil
+	if t.Get(openFile.path) == openFile {
+		t.m.Delete(openFile.path)
+	}
+
+	return openFile.path
+}
+
+// PathOf returns the path openFile is tracked at, or was last tracked at.
+func (t *OpenFilesTracker) PathOf(openFile *OpenFile) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return openFile.path
 }
 
 func (t *OpenFilesTracker) Get(path string) *OpenFile {
@@ -39,6 +193,185 @@ func (t *OpenFilesTracker) Get(path string) *OpenFile {
 	return nil
 }
 
+// Delete stops tracking path, as the version being written to there was removed. Handles holding a
+// reference to the entry can still release it, but the version must not be finalized.
 func (t *OpenFilesTracker) Delete(path string) {
-	t.m.Delete(path)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if val, ok := t.m.LoadAndDelete(path); ok {
+		val.(*OpenFile).removed = true
+	}
+}
+
+// IsRemoved returns true when the version for openFile was removed while it was being written to.
+func (t *OpenFilesTracker) IsRemoved(openFile *OpenFile) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return openFile.removed
+}
+
+// recordWrite updates the checksum state with data written at off. Writes that don't continue
+// from the end of the previous write mean the hasher no longer describes the file, so the
+// checksum will be computed from the file contents on release.
+func (f *OpenFile) recordWrite(data []byte, off int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.sequential {
+		return
+	}
+
+	if off != f.nextOffset {
+		f.sequential = false
+		return
+	}
+
+	_, _ = f.hasher.Write(data)
+	f.nextOffset += int64(len(data))
+}
+
+// recordUnknownWrite records a write whose offset isn't known, which means the file can no longer
+// be checksummed as it's written.
+func (f *OpenFile) recordUnknownWrite() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sequential = false
+}
+
+// recordTruncate updates the checksum state when the file is truncated to size. Truncating to
+// the amount already written leaves the file matching the hasher.
+func (f *OpenFile) recordTruncate(size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size != f.nextOffset {
+		f.sequential = false
+	}
+}
+
+// checkpoint returns the upload state of f, which is being written at path.
+func (f *OpenFile) checkpoint(path string) uploadState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := uploadState{
+		Path:         path,
+		FileID:       f.File.ID,
+		BytesWritten: f.nextOffset,
+		UpdatedAt:    time.Now(),
+	}
+
+	if f.sequential {
+		checkpoint, err := f.hasher.checkpoint()
+		if err == nil {
+			state.Checkpoint = checkpoint
+		}
+	}
+
+	return state
+}
+
+// resume restores the checksum state saved in state. When it can't be restored the checksum will
+// be computed from the file contents on release.
+func (f *OpenFile) resume(state uploadState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	hasher, err := restoreMultiHasher(f.hasher.algorithms, state.Checkpoint)
+	if err != nil {
+		f.sequential = false
+		return
+	}
+
+	f.hasher = hasher
+	f.nextOffset = state.BytesWritten
+}
+
+// computeDigests returns the digests for the file at path, whose final size is size. When all
+// writes were sequential the running hashes are used, otherwise the file is read and hashed again.
+func (f *OpenFile) computeDigests(path string, size int64) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.sequential && size == f.nextOffset {
+		return f.hasher.digests(), nil
+	}
+
+	return checksumFile(path, f.hasher.algorithms)
+}
+
+// Move moves the entry at fromPath to toPath. It returns the moved entry, or nil if there was
+// no entry at fromPath.
+func (t *OpenFilesTracker) Move(fromPath, toPath string) *OpenFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	val, ok := t.m.LoadAndDelete(fromPath)
+	if !ok {
+		return nil
+	}
+
+	openFile := val.(*OpenFile)
+	openFile.path = toPath
+	t.m.Store(toPath, openFile)
+	return openFile
+}
+
+// MoveDir moves every entry under the directory fromDirPath to be under toDirPath. It's used
+// when a directory is renamed while files below it are being written to.
+func (t *OpenFilesTracker) MoveDir(fromDirPath, toDirPath string) {
+	for _, path := range pathsUnder(&t.m, fromDirPath) {
+		toPath := toDirPath + strings.TrimPrefix(path, fromDirPath)
+		if openFile := t.Move(path, toPath); openFile != nil && openFile.File != nil && openFile.File.Directory != nil {
+			openFile.File.Directory.Path = filepath.Dir(toPath)
+		}
+	}
+}
+
+// Checkpoint returns the upload state of each version being written to.
+func (t *OpenFilesTracker) Checkpoint() []uploadState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var states []uploadState
+	t.m.Range(func(key, value interface{}) bool {
+		if openFile := value.(*OpenFile); openFile.File != nil {
+			states = append(states, openFile.checkpoint(openFile.path))
+		}
+		return true
+	})
+
+	return states
+}
+
+// FileIDs returns the ids of the file versions being written to.
+func (t *OpenFilesTracker) FileIDs() []int {
+	var ids []int
+	t.m.Range(func(key, value interface{}) bool {
+		if openFile := value.(*OpenFile); openFile.File != nil {
+			ids = append(ids, openFile.File.ID)
+		}
+		return true
+	})
+
+	return ids
+}
+
+// PathsUnder returns the paths of the tracked files that are below the directory dirPath.
+func (t *OpenFilesTracker) PathsUnder(dirPath string) []string {
+	return pathsUnder(&t.m, dirPath)
+}
+
+// pathsUnder returns the keys in m that are below the directory dirPath.
+func pathsUnder(m *sync.Map, dirPath string) []string {
+	var paths []string
+	m.Range(func(key, value interface{}) bool {
+		if path := key.(string); strings.HasPrefix(path, dirPath+"/") {
+			paths = append(paths, path)
+		}
+		return true
+	})
+
+	return paths
 }
@@ -0,0 +1,250 @@
+package mcbridgefs
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+// writeAt writes data at off in the file at path, and records the write in openFile the same way
+// FileHandle.Write does.
+func writeAt(t *testing.T, openFile *OpenFile, path string, data []byte, off int64) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	require.NoError(t, err, "OpenFile failed: %s", err)
+	defer fp.Close()
+
+	n, err := fp.WriteAt(data, off)
+	require.NoError(t, err, "WriteAt failed: %s", err)
+	openFile.recordWrite(data[:n], off)
+}
+
+func finalChecksum(t *testing.T, openFile *OpenFile, path string) string {
+	info, err := os.Stat(path)
+	require.NoError(t, err, "Stat failed: %s", err)
+	digests, err := openFile.computeDigests(path, info.Size())
+	require.NoError(t, err, "computeDigests failed: %s", err)
+	return digests[checksumMD5]
+}
+
+func expectedChecksum(t *testing.T, path string) string {
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "ReadFile failed: %s", err)
+	return fmt.Sprintf("%x", md5.Sum(contents))
+}
+
+func newTestOpenFile(t *testing.T) (*OpenFile, string) {
+	tracker := NewOpenFilesTracker()
+	tracker.Store("/file.txt", nil)
+	return tracker.Get("/file.txt"), filepath.Join(t.TempDir(), "file.txt")
+}
+
+func TestChecksumSequentialWrites(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("hello "), 0)
+	writeAt(t, openFile, path, []byte("world"), 6)
+
+	require.True(t, openFile.sequential, "Sequential writes should use the running hash")
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
+
+func TestChecksumOutOfOrderWrites(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("world"), 6)
+	writeAt(t, openFile, path, []byte("hello "), 0)
+
+	require.False(t, openFile.sequential, "Out of order writes should fall back to rehashing")
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
+
+func TestChecksumOverwrite(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("hello world"), 0)
+	writeAt(t, openFile, path, []byte("HELLO"), 0)
+
+	require.False(t, openFile.sequential, "Overwrites should fall back to rehashing")
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
+
+func TestChecksumAppend(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("hello "), 0)
+
+	// An append from another handle lands at the end of the file, wherever this handle thinks it is
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err, "OpenFile failed: %s", err)
+	_, err = fp.Write([]byte("world"))
+	require.NoError(t, err, "Write failed: %s", err)
+	require.NoError(t, fp.Close())
+	openFile.recordUnknownWrite()
+
+	require.False(t, openFile.sequential, "Appends should fall back to rehashing")
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
+
+func TestChecksumTruncate(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("hello world"), 0)
+	require.NoError(t, os.Truncate(path, 5))
+	openFile.recordTruncate(5)
+
+	require.False(t, openFile.sequential, "Truncating written data should fall back to rehashing")
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
+
+func TestChecksumSizeMismatch(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("hello"), 0)
+
+	// Extend the file without going through recordWrite, for example by fallocate
+	require.NoError(t, os.Truncate(path, 10))
+
+	require.True(t, openFile.sequential)
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
+
+func TestChecksumMultipleHandles(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("first "), 0)
+	writeAt(t, openFile, path, []byte("second"), 6)
+	writeAt(t, openFile, path, []byte("FIRST"), 0)
+
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
+
+func TestOpenFilesTrackerReleaseLastReference(t *testing.T) {
+	tracker := NewOpenFilesTracker()
+	openFile := tracker.Store("/file.txt", &mcmodel.File{ID: 1})
+	require.Equal(t, openFile, tracker.Acquire("/file.txt"), "Acquire should return the stored entry")
+
+	require.False(t, tracker.Release(openFile), "First release should not be the last")
+	require.NotNil(t, tracker.Get("/file.txt"), "Entry should be tracked while a reference is held")
+
+	require.True(t, tracker.Release(openFile), "Second release should be the last")
+	require.Nil(t, tracker.Get("/file.txt"), "Entry should be dropped on the last release")
+	require.Nil(t, tracker.Acquire("/file.txt"))
+}
+
+func TestOpenFilesTrackerReleaseAfterMove(t *testing.T) {
+	tracker := NewOpenFilesTracker()
+	openFile := tracker.Store("/a.txt", &mcmodel.File{ID: 1})
+	tracker.Move("/a.txt", "/b.txt")
+
+	require.True(t, tracker.Release(openFile))
+	require.Nil(t, tracker.Get("/b.txt"), "Entry should be dropped from the path it was moved to")
+}
+
+func TestOpenFilesTrackerReleaseDoesNotDropNewEntry(t *testing.T) {
+	tracker := NewOpenFilesTracker()
+	first := tracker.Store("/file.txt", &mcmodel.File{ID: 1})
+	tracker.Delete("/file.txt")
+	second := tracker.Store("/file.txt", &mcmodel.File{ID: 2})
+
+	require.True(t, tracker.Release(first))
+	require.Equal(t, second, tracker.Get("/file.txt"), "Releasing a removed entry should not drop its replacement")
+}
+
+func TestOpenFilesTrackerDeleteMarksRemoved(t *testing.T) {
+	tracker := NewOpenFilesTracker()
+	removed := tracker.Store("/file.txt", &mcmodel.File{ID: 1})
+	moved := tracker.Store("/other.txt", &mcmodel.File{ID: 2})
+
+	// Renaming onto a path being written to removes the version there first
+	tracker.Delete("/file.txt")
+	tracker.Move("/other.txt", "/file.txt")
+
+	require.True(t, tracker.IsRemoved(removed), "The replaced version should be marked as removed")
+	require.False(t, tracker.IsRemoved(moved), "The moved version should not be marked as removed")
+	require.Equal(t, moved, tracker.Get("/file.txt"))
+}
+
+func TestOpenFilesTrackerReleaseAfterFinalizes(t *testing.T) {
+	tracker := NewOpenFilesTracker()
+	openFile := tracker.Store("/dir/file.txt", &mcmodel.File{ID: 1})
+
+	finalized := make(chan string, 1)
+	require.True(t, tracker.ReleaseAfter(openFile, 10*time.Millisecond, func(path string) { finalized <- path }))
+	require.Equal(t, openFile, tracker.Get("/dir/file.txt"), "The entry should be kept during the grace period")
+
+	select {
+	case path := <-finalized:
+		require.Equal(t, "/dir/file.txt", path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The version was not finalized after the grace period")
+	}
+
+	require.Nil(t, tracker.Get("/dir/file.txt"))
+}
+
+func TestOpenFilesTrackerReacquireCancelsFinalize(t *testing.T) {
+	tracker := NewOpenFilesTracker()
+	openFile := tracker.Store("/dir/file.txt", &mcmodel.File{ID: 1})
+
+	finalized := make(chan string, 1)
+	require.True(t, tracker.ReleaseAfter(openFile, 50*time.Millisecond, func(path string) { finalized <- path }))
+	require.Equal(t, openFile, tracker.Acquire("/dir/file.txt"), "Reopening during the grace period continues the version")
+
+	select {
+	case <-finalized:
+		t.Fatal("A reopened version should not be finalized")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	require.True(t, tracker.Release(openFile))
+}
+
+func TestOpenFilesTrackerFinalizePending(t *testing.T) {
+	tracker := NewOpenFilesTracker()
+	openFile := tracker.Store("/dir/file.txt", &mcmodel.File{ID: 1})
+
+	var finalized []string
+	require.True(t, tracker.ReleaseAfter(openFile, time.Hour, func(path string) { finalized = append(finalized, path) }))
+
+	// The entry follows a rename during the grace period
+	tracker.MoveDir("/dir", "/other")
+	tracker.FinalizePending()
+
+	require.Equal(t, []string{"/other/file.txt"}, finalized)
+	require.Nil(t, tracker.Get("/other/file.txt"))
+
+	tracker.FinalizePending()
+	require.Len(t, finalized, 1, "A version should only be finalized once")
+}
+
+func TestChecksumResumeFromCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	tracker := NewOpenFilesTracker()
+	openFile := tracker.Store("/file.txt", &mcmodel.File{ID: 1})
+	writeAt(t, openFile, path, []byte("hello "), 0)
+
+	states := tracker.Checkpoint()
+	require.Len(t, states, 1)
+	require.Equal(t, "/file.txt", states[0].Path)
+	require.Equal(t, 1, states[0].FileID)
+	require.Equal(t, int64(6), states[0].BytesWritten)
+
+	// A restarted bridge continues the running hash from the checkpoint
+	resumed := NewOpenFilesTracker().Store("/file.txt", &mcmodel.File{ID: 1})
+	resumed.resume(states[0])
+	writeAt(t, resumed, path, []byte("world"), 6)
+
+	require.True(t, resumed.sequential, "Writes continuing from the checkpoint should use the running hash")
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, resumed, path))
+}
+
+func TestChecksumResumeWithoutCheckpoint(t *testing.T) {
+	openFile, path := newTestOpenFile(t)
+	writeAt(t, openFile, path, []byte("hello "), 0)
+
+	openFile.resume(uploadState{Path: "/file.txt", FileID: 1, BytesWritten: 6})
+	writeAt(t, openFile, path, []byte("world"), 6)
+
+	require.False(t, openFile.sequential, "Without a checkpoint the file should be hashed on release")
+	require.Equal(t, expectedChecksum(t, path), finalChecksum(t, openFile, path))
+}
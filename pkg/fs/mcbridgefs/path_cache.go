@@ -0,0 +1,97 @@
+package mcbridgefs
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// PathCache caches the directory entries that paths resolve to, so that resolving a path doesn't
+// need a query for the directory each time. It also caches negative entries, for paths where
+// nothing exists. Files aren't cached as their current version changes as they are written.
+//
+// The cache holds at most size entries, evicting the least recently used entries once it's full.
+// Entries expire after the TTL, which bounds how long changes made outside this bridge take to show
+// up. Changes made through the bridge invalidate the affected paths.
+type PathCache struct {
+	cache *lruCache
+
+	hits   uint64
+	misses uint64
+}
+
+// PathCacheStats are the hit and miss counts for a PathCache.
+type PathCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// NewPathCache creates a new PathCache holding up to size entries, which are valid for ttl. A size
+// or ttl of zero turns off caching.
+func NewPathCache(size int, ttl time.Duration) *PathCache {
+	if ttl <= 0 {
+		size = 0
+	}
+
+	return &PathCache{cache: newLRUCache(size, ttl)}
+}
+
+// Get returns the directory cached for path. ok is false when path isn't cached. When ok is true
+// and dir is nil then path is cached as not existing. The directory returned is a copy, so callers
+// are free to modify it.
+func (c *PathCache) Get(path string) (dir *mcmodel.File, ok bool) {
+	value, ok := c.cache.get(path)
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+
+	cached := value.(*mcmodel.File)
+	if cached == nil {
+		return nil, true
+	}
+
+	dirCopy := *cached
+	return &dirCopy, true
+}
+
+// Store caches dir as the directory at path. A nil dir caches path as not existing.
+func (c *PathCache) Store(path string, dir *mcmodel.File) {
+	var dirCopy *mcmodel.File
+	if dir != nil {
+		d := *dir
+		dirCopy = &d
+	}
+
+	c.cache.store(path, dirCopy)
+}
+
+// Invalidate removes the cached entries for the given paths.
+func (c *PathCache) Invalidate(paths ...string) {
+	for _, path := range paths {
+		c.cache.remove(path)
+	}
+}
+
+// InvalidateTree removes the cached entries for path and everything under it.
+func (c *PathCache) InvalidateTree(path string) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	c.cache.removeIf(func(key interface{}) bool {
+		p := key.(string)
+		return p == path || strings.HasPrefix(p, prefix)
+	})
+}
+
+// Stats returns the hit and miss counts, and the number of cached entries.
+func (c *PathCache) Stats() PathCacheStats {
+	return PathCacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: c.cache.len(),
+	}
+}
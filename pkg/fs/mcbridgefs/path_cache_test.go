@@ -0,0 +1,58 @@
+package mcbridgefs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathCacheGetStore(t *testing.T) {
+	c := NewPathCache(10, time.Minute)
+
+	_, ok := c.Get("/dir")
+	require.False(t, ok, "Empty cache should not have entry")
+
+	c.Store("/dir", &mcmodel.File{ID: 2, Path: "/dir"})
+	dir, ok := c.Get("/dir")
+	require.True(t, ok, "Entry should be cached")
+	require.Equal(t, 2, dir.ID)
+
+	// Callers get a copy, so modifying it doesn't change the cached entry
+	dir.ID = 3
+	dir, _ = c.Get("/dir")
+	require.Equal(t, 2, dir.ID)
+
+	stats := c.Stats()
+	require.Equal(t, uint64(2), stats.Hits)
+	require.Equal(t, uint64(1), stats.Misses)
+	require.Equal(t, 1, stats.Entries)
+}
+
+func TestPathCacheNegativeEntry(t *testing.T) {
+	c := NewPathCache(10, time.Minute)
+	c.Store("/missing", nil)
+
+	dir, ok := c.Get("/missing")
+	require.True(t, ok, "Negative entry should be cached")
+	require.Nil(t, dir)
+}
+
+func TestPathCacheInvalidateTree(t *testing.T) {
+	c := NewPathCache(10, time.Minute)
+	c.Store("/a", &mcmodel.File{ID: 1})
+	c.Store("/a/b", &mcmodel.File{ID: 2})
+	c.Store("/a/b/c", nil)
+	c.Store("/ab", &mcmodel.File{ID: 3})
+
+	c.InvalidateTree("/a")
+
+	for _, path := range []string{"/a", "/a/b", "/a/b/c"} {
+		_, ok := c.Get(path)
+		require.False(t, ok, "%s should have been invalidated", path)
+	}
+
+	_, ok := c.Get("/ab")
+	require.True(t, ok, "/ab is not under /a")
+}
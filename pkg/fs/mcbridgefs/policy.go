@@ -0,0 +1,140 @@
+package mcbridgefs
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// bridgePolicy holds the settings that control how a bridge handles files, such as which
+// destructive operations it allows. A bridge instance only ever serves a single transfer
+// request, so the policy is per transfer request and is loaded from the environment the bridge
+// was started with (see mcbridgefsd startBridge).
+type bridgePolicy struct {
+	// allowDeleteExisting allows files that existed before the transfer request was opened to
+	// be removed. Files created during the transfer request can always be removed.
+	allowDeleteExisting bool
+
+	// recursiveRmdir allows rmdir to remove a non-empty directory along with everything under
+	// it, as long as the whole subtree was created during the transfer request.
+	recursiveRmdir bool
+
+	// checksumAlgorithms are the checksums computed for files written through the bridge. The
+	// first one is the primary algorithm, whose digest is stored as the file checksum.
+	checksumAlgorithms []string
+
+	// fileModeMask limits the permission bits that can be set on a file with chmod. Whatever
+	// the mask, the owner can always read and write the file so that the bridge and Materials
+	// Commons can still access it.
+	fileModeMask uint32
+
+	// reopenPolicy decides what happens when a file written during the transfer request is opened
+	// for write again after it was released. See reopenNewVersion and reopenContinueVersion.
+	reopenPolicy string
+
+	// reopenGrace is how long a version is kept open after its last release when versions are
+	// continued, before it's finalized.
+	reopenGrace time.Duration
+
+	// symlinkPolicy decides how symlinks created through the bridge are stored. See symlinkStore
+	// and symlinkDereference.
+	symlinkPolicy string
+}
+
+// The reopen policies. reopenNewVersion creates a new version of the file each time it is opened
+// for write after being released. reopenContinueVersion delays finalizing a version for the
+// reopen grace period after it's released, and continues writing to it when the file is opened for
+// write again in that time, so that tools that open and close a file repeatedly don't create a
+// version each time. Once a version is finalized it's never written to again.
+const (
+	reopenNewVersion      = "new-version"
+	reopenContinueVersion = "continue-version"
+)
+
+// The symlink policies. symlinkStore stores a symlink as an entry holding its target, which
+// Readlink serves back. symlinkDereference stores the file the link points at as a regular file
+// instead, for uploads where the links should be replaced by the files they refer to.
+const (
+	symlinkStore       = "store"
+	symlinkDereference = "dereference"
+)
+
+// defaultReopenGrace is the reopen grace period when it isn't set.
+const defaultReopenGrace = 5 * time.Second
+
+// defaultFileModeMask allows everything except the setuid, setgid and sticky bits, and write
+// access for group and other.
+const defaultFileModeMask = 0755
+
+// requiredFileMode are the permission bits that are always set on files.
+const requiredFileMode = 0600
+
+// loadPolicyFromEnv creates a bridgePolicy from the MC_BRIDGE_* environment variables. Any
+// variable that is not set, or can't be parsed, falls back to the most restrictive setting.
+func loadPolicyFromEnv() bridgePolicy {
+	return bridgePolicy{
+		allowDeleteExisting: envBool("MC_BRIDGE_ALLOW_DELETE_EXISTING"),
+		recursiveRmdir:      envBool("MC_BRIDGE_RECURSIVE_RMDIR"),
+		checksumAlgorithms:  parseChecksumAlgorithms(os.Getenv("MC_BRIDGE_CHECKSUMS")),
+		fileModeMask:        envOctal("MC_BRIDGE_FILE_MODE_MASK", defaultFileModeMask),
+		reopenPolicy:        parseReopenPolicy(os.Getenv("MC_BRIDGE_REOPEN_POLICY")),
+		reopenGrace:         envDuration("MC_BRIDGE_REOPEN_GRACE", defaultReopenGrace),
+		symlinkPolicy:       parseSymlinkPolicy(os.Getenv("MC_BRIDGE_SYMLINK_POLICY")),
+	}
+}
+
+// parseReopenPolicy returns the reopen policy for val, defaulting to creating new versions.
+func parseReopenPolicy(val string) string {
+	if val == reopenContinueVersion {
+		return reopenContinueVersion
+	}
+
+	return reopenNewVersion
+}
+
+// parseSymlinkPolicy returns the symlink policy for val, defaulting to storing symlinks.
+func parseSymlinkPolicy(val string) string {
+	if val == symlinkDereference {
+		return symlinkDereference
+	}
+
+	return symlinkStore
+}
+
+// fileMode returns the permission bits the policy allows for a chmod to mode.
+func (p bridgePolicy) fileMode(mode uint32) uint32 {
+	return mode&p.fileModeMask&07777 | requiredFileMode
+}
+
+// envBool returns the boolean value of an environment variable. Unset or invalid values are
+// treated as false.
+func envBool(name string) bool {
+	val, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return false
+	}
+
+	return val
+}
+
+// envOctal returns the value of an environment variable holding an octal number, such as a file
+// mode. Unset or invalid values return defaultValue.
+func envOctal(name string, defaultValue uint32) uint32 {
+	val, err := strconv.ParseUint(os.Getenv(name), 8, 32)
+	if err != nil {
+		return defaultValue
+	}
+
+	return uint32(val)
+}
+
+// envDuration returns the value of an environment variable holding a duration, such as "5s".
+// Unset, invalid or negative values return defaultValue.
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	val, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || val < 0 {
+		return defaultValue
+	}
+
+	return val
+}
@@ -0,0 +1,51 @@
+package mcbridgefs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyFileMode(t *testing.T) {
+	p := bridgePolicy{fileModeMask: defaultFileModeMask}
+
+	require.Equal(t, uint32(0644), p.fileMode(0644))
+	require.Equal(t, uint32(0755), p.fileMode(0777), "Group and other write should be masked")
+	require.Equal(t, uint32(0755), p.fileMode(04755), "setuid should be masked")
+	require.Equal(t, uint32(0600), p.fileMode(0), "Owner read and write should always be set")
+
+	p.fileModeMask = 0700
+	require.Equal(t, uint32(0700), p.fileMode(0755))
+}
+
+func TestEnvOctal(t *testing.T) {
+	defer os.Unsetenv("MC_BRIDGE_FILE_MODE_MASK")
+
+	_ = os.Setenv("MC_BRIDGE_FILE_MODE_MASK", "0750")
+	require.Equal(t, uint32(0750), envOctal("MC_BRIDGE_FILE_MODE_MASK", defaultFileModeMask))
+
+	_ = os.Setenv("MC_BRIDGE_FILE_MODE_MASK", "not-a-mode")
+	require.Equal(t, uint32(defaultFileModeMask), envOctal("MC_BRIDGE_FILE_MODE_MASK", defaultFileModeMask))
+}
+
+func TestEnvDuration(t *testing.T) {
+	defer os.Unsetenv("MC_BRIDGE_REOPEN_GRACE")
+
+	_ = os.Setenv("MC_BRIDGE_REOPEN_GRACE", "30s")
+	require.Equal(t, 30*time.Second, envDuration("MC_BRIDGE_REOPEN_GRACE", defaultReopenGrace))
+
+	_ = os.Setenv("MC_BRIDGE_REOPEN_GRACE", "")
+	require.Equal(t, defaultReopenGrace, envDuration("MC_BRIDGE_REOPEN_GRACE", defaultReopenGrace))
+
+	_ = os.Setenv("MC_BRIDGE_REOPEN_GRACE", "-1s")
+	require.Equal(t, defaultReopenGrace, envDuration("MC_BRIDGE_REOPEN_GRACE", defaultReopenGrace))
+}
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	require.Equal(t, symlinkDereference, parseSymlinkPolicy("dereference"))
+	require.Equal(t, symlinkStore, parseSymlinkPolicy("store"))
+	require.Equal(t, symlinkStore, parseSymlinkPolicy(""))
+	require.Equal(t, symlinkStore, parseSymlinkPolicy("follow"))
+}
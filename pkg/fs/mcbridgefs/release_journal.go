@@ -0,0 +1,499 @@
+package mcbridgefs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
+)
+
+// ReleaseJournal is an append-only journal of the versions being finalized by Release. Finalizing a
+// version takes several database updates after its file is closed. If one of them fails, or the
+// bridge dies part way through, the uploaded bytes are on disk but the version never becomes
+// current. Each step is journaled, and synced to disk, so that the recovery pass the next time the
+// bridge starts for the transfer request can finish any release that didn't complete.
+//
+// A release goes through these steps:
+//
+//	pending  - the file was closed, and is about to be marked as released
+//	released - the version was marked as released, and is about to be queued for conversion
+//	queued   - the version was queued for conversion
+//	done     - the release is finished
+//
+// A release that fails part way through while the bridge is running is retried in the background.
+// The journal is compacted down to the unfinished releases once it grows past compactSize.
+type ReleaseJournal struct {
+	stateDir    string
+	compactSize int64
+
+	mu sync.Mutex
+	fp *os.File
+
+	// written is the size of the journal, and compacting is set while it's being compacted.
+	written    int64
+	compacting bool
+
+	// unfinished holds the ids of the versions whose release was journaled but isn't done.
+	unfinished map[int]bool
+
+	// retry holds the releases to try finishing again, keyed by file id. retryTimer is set while
+	// the next attempt is scheduled.
+	retry      map[int]releaseJournalEntry
+	retryTimer *time.Timer
+}
+
+// The steps recorded in the journal.
+const (
+	journalPending  = "pending"
+	journalReleased = "released"
+	journalQueued   = "queued"
+	journalDone     = "done"
+)
+
+// defaultJournalCompactSize is the size the journal grows to before it's compacted.
+const defaultJournalCompactSize = 1 << 20
+
+// releaseRetryInterval is how long to wait before trying to finish a failed release again.
+const releaseRetryInterval = 30 * time.Second
+
+// releaseJournalEntry is a single line in the journal. The checksum and size are only recorded
+// for the pending step.
+type releaseJournalEntry struct {
+	Step     string    `json:"step"`
+	FileID   int       `json:"file_id"`
+	Path     string    `json:"path,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// NewReleaseJournal creates a ReleaseJournal that keeps its journal files in stateDir.
+func NewReleaseJournal(stateDir string) *ReleaseJournal {
+	return &ReleaseJournal{
+		stateDir:    stateDir,
+		compactSize: defaultJournalCompactSize,
+		unfinished:  make(map[int]bool),
+		retry:       make(map[int]releaseJournalEntry),
+	}
+}
+
+// RecoverReleases finishes the releases left unfinished by an earlier run of the bridge for the
+// transfer request. It must be called after CreateFS, and before the mount starts serving requests.
+// It returns an error when the state directory can't be written to, as then neither releases nor
+// uploads can be recovered after a crash.
+func RecoverReleases() error {
+	if err := checkStateDir(releaseJournal.stateDir); err != nil {
+		return err
+	}
+
+	releaseJournal.Recover()
+	return nil
+}
+
+// checkStateDir makes sure the directory holding the upload state and the release journal exists,
+// and can be written to.
+func checkStateDir(stateDir string) error {
+	if stateDir == "" {
+		return fmt.Errorf("no state directory, set MC_UPLOAD_STATE_DIR or MCFS_DIR")
+	}
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+
+	fp, err := ioutil.TempFile(stateDir, ".check-")
+	if err != nil {
+		return err
+	}
+
+	_ = fp.Close()
+	return os.Remove(fp.Name())
+}
+
+// FinalizePendingReleases finalizes the versions waiting out the reopen grace period right away.
+// It must be called when the bridge is stopping, after the mount is unmounted.
+func FinalizePendingReleases() {
+	openedFilesTracker.FinalizePending()
+}
+
+// Pending records that the version f at path is about to be marked as released with the given
+// checksum and size.
+func (j *ReleaseJournal) Pending(f *mcmodel.File, path, checksum string, size int64) {
+	j.append(releaseJournalEntry{Step: journalPending, FileID: f.ID, Path: path, Checksum: checksum, Size: size})
+}
+
+// Released records that the version f was marked as released.
+func (j *ReleaseJournal) Released(f *mcmodel.File) {
+	j.append(releaseJournalEntry{Step: journalReleased, FileID: f.ID})
+}
+
+// Queued records that the version f was queued for conversion. It's journaled as a step of its own
+// so that recovering the release doesn't queue the version again.
+func (j *ReleaseJournal) Queued(f *mcmodel.File) {
+	j.append(releaseJournalEntry{Step: journalQueued, FileID: f.ID})
+}
+
+// Done records that the release of the version f is finished.
+func (j *ReleaseJournal) Done(f *mcmodel.File) {
+	j.append(releaseJournalEntry{Step: journalDone, FileID: f.ID})
+}
+
+// IsUnfinished returns true when the release of the version with id fileID was journaled, but
+// isn't done.
+func (j *ReleaseJournal) IsUnfinished(fileID int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.unfinished[fileID]
+}
+
+// RetryLater schedules the release of the version f at path, which failed after reaching step, to
+// be finished in the background.
+func (j *ReleaseJournal) RetryLater(f *mcmodel.File, path, checksum string, size int64, step string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.scheduleRetry(releaseJournalEntry{Step: step, FileID: f.ID, Path: path, Checksum: checksum, Size: size})
+}
+
+// scheduleRetry adds entry to the releases to try finishing again. j.mu must be held.
+func (j *ReleaseJournal) scheduleRetry(entry releaseJournalEntry) {
+	j.retry[entry.FileID] = entry
+	if j.retryTimer == nil {
+		j.retryTimer = time.AfterFunc(releaseRetryInterval, j.retryFailed)
+	}
+}
+
+// retryFailed tries to finish the releases that failed again. Those that still fail are scheduled
+// for another attempt.
+func (j *ReleaseJournal) retryFailed() {
+	j.mu.Lock()
+	j.retryTimer = nil
+	var entries []releaseJournalEntry
+	for id, entry := range j.retry {
+		entries = append(entries, entry)
+		delete(j.retry, id)
+	}
+	j.mu.Unlock()
+
+	for _, entry := range entries {
+		step := entry.Step
+		err := recoverRelease(&entry)
+		if entry.Step != step {
+			j.append(releaseJournalEntry{Step: entry.Step, FileID: entry.FileID})
+		}
+
+		if err != nil {
+			log.Errorf("Failed finishing release of version %d of %s, will retry: %s", entry.FileID, entry.Path, err)
+			j.mu.Lock()
+			j.scheduleRetry(entry)
+			j.mu.Unlock()
+			continue
+		}
+
+		pathCache.Invalidate(entry.Path)
+		j.append(releaseJournalEntry{Step: journalDone, FileID: entry.FileID})
+	}
+}
+
+// append writes entry to the journal and syncs it to disk. Failing to journal a release doesn't
+// stop the release, it only means it can't be recovered.
+func (j *ReleaseJournal) append(entry releaseJournalEntry) {
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Failed journaling release of version %d: %s", entry.FileID, err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if entry.Step == journalDone {
+		delete(j.unfinished, entry.FileID)
+	} else {
+		j.unfinished[entry.FileID] = true
+	}
+
+	if j.fp == nil {
+		if err := os.MkdirAll(j.stateDir, 0700); err != nil {
+			log.Errorf("Failed creating release journal directory %s: %s", j.stateDir, err)
+			return
+		}
+
+		if j.fp, err = os.OpenFile(j.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			log.Errorf("Failed opening release journal %s: %s", j.journalPath(), err)
+			return
+		}
+
+		if info, err := j.fp.Stat(); err == nil {
+			j.written = info.Size()
+		}
+	}
+
+	if _, err := j.fp.Write(append(line, '\n')); err != nil {
+		log.Errorf("Failed journaling release of version %d: %s", entry.FileID, err)
+		return
+	}
+
+	if err := j.fp.Sync(); err != nil {
+		log.Errorf("Failed syncing release journal: %s", err)
+	}
+
+	j.written += int64(len(line) + 1)
+	if j.written >= j.compactSize && !j.compacting {
+		j.compacting = true
+		go j.compact()
+	}
+}
+
+// compact rewrites the journal down to the releases that aren't finished, so that it doesn't keep
+// growing while the bridge runs.
+func (j *ReleaseJournal) compact() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.compacting = false
+
+	unfinished, err := j.readUnfinished()
+	if err == nil {
+		err = j.rewrite(unfinished)
+	}
+
+	if err != nil {
+		// Wait for the journal to grow by another compactSize before trying again
+		j.written = 0
+		log.Errorf("Failed compacting release journal %s: %s", j.journalPath(), err)
+	}
+}
+
+// Recover finishes the unfinished releases in the journal, and then compacts the journal down to
+// the releases that still couldn't be finished. Those are retried in the background, and on the
+// next start if the bridge stops before they are finished.
+func (j *ReleaseJournal) Recover() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	unfinished, err := j.readUnfinished()
+	if err != nil {
+		log.Errorf("Failed reading release journal %s: %s", j.journalPath(), err)
+		return
+	}
+
+	var remaining []releaseJournalEntry
+	for _, entry := range unfinished {
+		if err := recoverRelease(&entry); err != nil {
+			log.Errorf("Failed recovering release of version %d of %s: %s", entry.FileID, entry.Path, err)
+			remaining = append(remaining, entry)
+			j.unfinished[entry.FileID] = true
+			j.scheduleRetry(entry)
+		}
+	}
+
+	if err := j.rewrite(remaining); err != nil {
+		log.Errorf("Failed compacting release journal %s: %s", j.journalPath(), err)
+	}
+}
+
+// readUnfinished returns the last step journaled for each release that isn't done, in the order
+// the releases were started. The pending step is kept as it has the checksum and size, with its
+// step updated to the last step reached. A partially written last line, from a crash while it
+// was being appended, is ignored.
+func (j *ReleaseJournal) readUnfinished() ([]releaseJournalEntry, error) {
+	fp, err := os.Open(j.journalPath())
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer fp.Close()
+
+	var order []int
+	entries := make(map[int]releaseJournalEntry)
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var entry releaseJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Errorf("Skipping invalid release journal entry %q: %s", scanner.Text(), err)
+			continue
+		}
+
+		switch entry.Step {
+		case journalPending:
+			if _, ok := entries[entry.FileID]; !ok {
+				order = append(order, entry.FileID)
+			}
+			entries[entry.FileID] = entry
+		case journalReleased, journalQueued:
+			// A released or queued step on its own comes from an earlier compaction of the
+			// journal, and holds everything the pending step did.
+			pending, ok := entries[entry.FileID]
+			if !ok {
+				order = append(order, entry.FileID)
+				pending = entry
+			}
+			pending.Step = entry.Step
+			entries[entry.FileID] = pending
+		case journalDone:
+			delete(entries, entry.FileID)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var unfinished []releaseJournalEntry
+	for _, id := range order {
+		if entry, ok := entries[id]; ok {
+			unfinished = append(unfinished, entry)
+			delete(entries, id)
+		}
+	}
+
+	return unfinished, nil
+}
+
+// rewrite atomically replaces the journal with entries.
+func (j *ReleaseJournal) rewrite(entries []releaseJournalEntry) error {
+	if err := os.MkdirAll(j.stateDir, 0700); err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	tmpPath := j.journalPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	if j.fp != nil {
+		_ = j.fp.Close()
+		j.fp = nil
+	}
+
+	return os.Rename(tmpPath, j.journalPath())
+}
+
+func (j *ReleaseJournal) journalPath() string {
+	return filepath.Join(j.stateDir, fmt.Sprintf("transfer-request-%d.journal", transferRequest.ID))
+}
+
+// recoverRelease finishes a single release, based on the state of its version in the database.
+// Versions that were removed, or that were replaced by a newer current version in the meantime,
+// are left alone. The bytes of a replaced version are still available as a previous version. A
+// version is only marked as released again when the bridge died before journaling that it was,
+// which sets the same checksum and size again. Like Release, a version identical to the current
+// one is discarded rather than added, which happens when the bridge died during the reopen grace
+// period of a file that was opened for write without being changed. The step reached is recorded
+// in entry, so that a release that fails part way through is picked up from there next time.
+func recoverRelease(entry *releaseJournalEntry) error {
+	var versions []mcmodel.File
+	err := db.Preload("Directory").Where("id = ?", entry.FileID).Where("deleted_at IS NULL").Find(&versions).Error
+	switch {
+	case err != nil:
+		return err
+	case len(versions) == 0:
+		log.Infof("Not recovering release of %s, version %d was removed", entry.Path, entry.FileID)
+		return nil
+	}
+
+	f := &versions[0]
+
+	if entry.Step == journalPending {
+		var newer int64
+		err := db.Model(&mcmodel.File{}).
+			Where("directory_id = ?", f.DirectoryID).
+			Where("name = ?", f.Name).
+			Where("current = ?", true).
+			Where("id > ?", f.ID).
+			Where("deleted_at IS NULL").
+			Count(&newer).Error
+		switch {
+		case err != nil:
+			return err
+		case newer != 0:
+			log.Infof("Not recovering release of %s, version %d was replaced by a newer version", entry.Path, f.ID)
+			return nil
+		}
+
+		checksum, size, err := recoveredChecksum(f, entry)
+		switch {
+		case os.IsNotExist(err):
+			// There are no bytes left to recover
+			log.Errorf("Unable to recover release of %s, the contents of version %d are missing", entry.Path, f.ID)
+			return nil
+		case err != nil:
+			return err
+		}
+
+		current, err := getCurrentEntryInDir(f.DirectoryID, f.Name)
+		switch {
+		case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		case err == nil && isUnchangedVersion(current, f, checksum, uint64(size)):
+			log.Infof("Not recovering release of %s, version %d is identical to the current version", entry.Path, f.ID)
+			deleteFileVersion(f)
+			return nil
+		}
+
+		if err := transferRequestStore.MarkFileReleased(f, checksum, transferRequest.ProjectID, size); err != nil {
+			return err
+		}
+
+		entry.Step = journalReleased
+		log.Infof("Recovered release of version %d of %s", f.ID, entry.Path)
+	}
+
+	if entry.Step == journalReleased && f.IsConvertible() {
+		if _, err := conversionStore.AddFileToConvert(f); err != nil {
+			return err
+		}
+
+		entry.Step = journalQueued
+	}
+
+	return nil
+}
+
+// recoveredChecksum returns the checksum and size to release f with. They are the journaled ones,
+// unless the underlying file no longer matches the journaled size, in which case the checksum is
+// computed again.
+func recoveredChecksum(f *mcmodel.File, entry *releaseJournalEntry) (string, int64, error) {
+	underlyingPath := f.ToUnderlyingFilePath(mcfsRoot)
+
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(underlyingPath, &st); err != nil {
+		return "", 0, err
+	}
+
+	if entry.Checksum != "" && st.Size == entry.Size {
+		return entry.Checksum, entry.Size, nil
+	}
+
+	digests, err := checksumFile(underlyingPath, policy.checksumAlgorithms)
+	if err != nil {
+		return "", 0, err
+	}
+
+	primary := policy.checksumAlgorithms[0]
+	return formatChecksum(primary, digests[primary]), st.Size, nil
+}
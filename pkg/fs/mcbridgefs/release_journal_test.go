@@ -0,0 +1,119 @@
+package mcbridgefs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleaseJournalUnfinished(t *testing.T) {
+	j := NewReleaseJournal(t.TempDir())
+
+	j.Pending(&mcmodel.File{ID: 1}, "/done.txt", "abc", 3)
+	j.Released(&mcmodel.File{ID: 1})
+	j.Done(&mcmodel.File{ID: 1})
+
+	j.Pending(&mcmodel.File{ID: 2}, "/pending.txt", "def", 4)
+
+	j.Pending(&mcmodel.File{ID: 3}, "/released.txt", "ghi", 5)
+	j.Released(&mcmodel.File{ID: 3})
+
+	unfinished, err := j.readUnfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 2)
+
+	require.Equal(t, 2, unfinished[0].FileID)
+	require.Equal(t, journalPending, unfinished[0].Step)
+	require.Equal(t, "/pending.txt", unfinished[0].Path)
+	require.Equal(t, "def", unfinished[0].Checksum)
+	require.Equal(t, int64(4), unfinished[0].Size)
+
+	require.Equal(t, 3, unfinished[1].FileID)
+	require.Equal(t, journalReleased, unfinished[1].Step)
+	require.Equal(t, "/released.txt", unfinished[1].Path, "Released entries should keep the pending details")
+
+	require.False(t, j.IsUnfinished(1))
+	require.True(t, j.IsUnfinished(2))
+	require.True(t, j.IsUnfinished(3))
+}
+
+func TestReleaseJournalRewrite(t *testing.T) {
+	j := NewReleaseJournal(t.TempDir())
+	j.Pending(&mcmodel.File{ID: 1}, "/file.txt", "abc", 3)
+	j.Released(&mcmodel.File{ID: 1})
+
+	unfinished, err := j.readUnfinished()
+	require.NoError(t, err)
+	require.NoError(t, j.rewrite(unfinished))
+
+	// The journal is appended to after being compacted
+	j.Pending(&mcmodel.File{ID: 2}, "/other.txt", "def", 4)
+	j.Done(&mcmodel.File{ID: 2})
+
+	unfinished, err = j.readUnfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	require.Equal(t, 1, unfinished[0].FileID)
+	require.Equal(t, journalReleased, unfinished[0].Step)
+	require.Equal(t, "abc", unfinished[0].Checksum)
+}
+
+func TestReleaseJournalIgnoresPartialLine(t *testing.T) {
+	j := NewReleaseJournal(t.TempDir())
+	j.Pending(&mcmodel.File{ID: 1}, "/file.txt", "abc", 3)
+
+	fp, err := os.OpenFile(j.journalPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = fp.WriteString(`{"step":"done","fi`)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	unfinished, err := j.readUnfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+
+	contents, err := ioutil.ReadFile(j.journalPath())
+	require.NoError(t, err)
+	require.Contains(t, string(contents), `"step":"pending"`)
+}
+
+func TestReleaseJournalQueued(t *testing.T) {
+	j := NewReleaseJournal(t.TempDir())
+	j.Pending(&mcmodel.File{ID: 1}, "/file.txt", "abc", 3)
+	j.Released(&mcmodel.File{ID: 1})
+	j.Queued(&mcmodel.File{ID: 1})
+
+	unfinished, err := j.readUnfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	require.Equal(t, journalQueued, unfinished[0].Step, "A queued version should not be queued for conversion again")
+	require.Equal(t, "/file.txt", unfinished[0].Path)
+}
+
+func TestReleaseJournalCompactsWhenLarge(t *testing.T) {
+	j := NewReleaseJournal(t.TempDir())
+	j.compactSize = 512
+
+	for id := 1; id <= 10; id++ {
+		j.Pending(&mcmodel.File{ID: id}, "/file.txt", "abc", 3)
+		j.Released(&mcmodel.File{ID: id})
+		j.Done(&mcmodel.File{ID: id})
+	}
+	j.Pending(&mcmodel.File{ID: 11}, "/pending.txt", "def", 4)
+
+	require.Eventually(t, func() bool {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		info, err := os.Stat(j.journalPath())
+		return err == nil && info.Size() < j.compactSize && !j.compacting
+	}, 5*time.Second, 10*time.Millisecond, "The journal should be compacted once it's larger than compactSize")
+
+	unfinished, err := j.readUnfinished()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	require.Equal(t, 11, unfinished[0].FileID)
+}
@@ -0,0 +1,271 @@
+package mcbridgefs
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// Symlinks are stored as Materials Commons files with the symlinkMimeType mime type. The target
+// of the link is the content of the file, so it's versioned, checksummed and moved around like
+// any other file. Only relative targets that stay inside the project can be stored, as anything
+// else would refer to files outside of Materials Commons.
+const symlinkMimeType = "inode/symlink"
+
+// maxSymlinkHops is the most links followed when resolving a chain of symlinks, matching the
+// limit Linux uses before failing with ELOOP.
+const maxSymlinkHops = 40
+
+var _ = (fs.NodeSymlinker)((*Node)(nil))
+var _ = (fs.NodeReadlinker)((*Node)(nil))
+
+// isSymlink returns true when f is a symlink.
+func isSymlink(f *mcmodel.File) bool {
+	return f.MimeType == symlinkMimeType
+}
+
+// Symlink creates the symlink name pointing at target. Depending on the bridge policy the link is
+// either stored as is, or dereferenced by storing the file it points at as a regular file.
+func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if name == versionsDirName {
+		return nil, syscall.EEXIST
+	}
+
+	dirPath := filepath.Join("/", n.Path(n.Root()))
+	path := filepath.Join(dirPath, name)
+
+	if _, err := getEntryByPath(path); err == nil || getFromOpenedFiles(path) != nil {
+		return nil, syscall.EEXIST
+	}
+
+	targetPath, ok := resolveSymlinkTarget(dirPath, target)
+	if !ok {
+		log.Errorf("Symlink: rejecting %s, its target %s is outside of the project", path, target)
+		return nil, syscall.EPERM
+	}
+
+	if policy.symlinkPolicy == symlinkDereference {
+		return n.dereferenceSymlink(ctx, target, targetPath, name, out)
+	}
+
+	f, err := n.createReleasedMCFile(name, symlinkMimeType, func(underlyingPath string) error {
+		return ioutil.WriteFile(underlyingPath, []byte(target), 0644)
+	})
+	if err != nil {
+		log.Errorf("Symlink: failed creating %s: %s", path, err)
+		return nil, syscall.EIO
+	}
+
+	createdFilesTracker.Add(path)
+	touchParentDirs(f.DirectoryID)
+	n.invalidateCaches(name)
+
+	stableAttr := n.stableAttr(f)
+	if errno := getEntryAttr(path, f, stableAttr.Ino, &out.Attr); errno != fs.OK {
+		return nil, errno
+	}
+
+	node := n.newNode()
+	node.file = f
+	return n.newChildInode(ctx, node, stableAttr), fs.OK
+}
+
+// dereferenceSymlink stores the file at targetPath, following any further links, as the regular
+// file name. The contents are copied, and then shared with the file they came from through
+// deduplication, so they aren't stored twice.
+//
+// The kernel expects the reply to a symlink call to be a symlink, so the reply is a short lived
+// link to target that isn't cached. The next lookup of name finds the regular file.
+func (n *Node) dereferenceSymlink(ctx context.Context, target, targetPath, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	path := filepath.Join("/", n.Path(n.Root()), name)
+
+	src, errno := resolveSymlinkChain(targetPath)
+	if errno != fs.OK {
+		log.Errorf("Symlink: unable to dereference %s, its target %s can't be resolved: %s", path, target, errno)
+		return nil, errno
+	}
+
+	f, err := n.createReleasedMCFile(name, src.MimeType, func(underlyingPath string) error {
+		return copyFileContents(underlyingPath, src.ToUnderlyingFilePath(mcfsRoot))
+	})
+	if err != nil {
+		log.Errorf("Symlink: failed dereferencing %s: %s", path, err)
+		return nil, syscall.EIO
+	}
+
+	dedupFileVersion(f, f.Checksum, int64(f.Size))
+
+	createdFilesTracker.Add(path)
+	touchParentDirs(f.DirectoryID)
+	n.invalidateCaches(name)
+
+	now := time.Now()
+	out.Mode = syscall.S_IFLNK | 0777
+	out.Size = uint64(len(target))
+	out.Uid = uid
+	out.Gid = gid
+	out.SetTimes(&now, &now, &now)
+	out.SetEntryTimeout(0)
+	out.SetAttrTimeout(0)
+
+	return n.NewInode(ctx, &dereferencedLinkNode{target: target}, fs.StableAttr{Mode: syscall.S_IFLNK}), fs.OK
+}
+
+// Readlink returns the stored target of a symlink. The target is checked again, as a relative target
+// that was inside the project when the link was created can point outside of it once the link is
+// moved.
+func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	path := filepath.Join("/", n.Path(n.Root()))
+	f, err := getEntryByPath(path)
+	switch {
+	case err != nil:
+		return nil, syscall.ENOENT
+	case !isSymlink(f):
+		return nil, syscall.EINVAL
+	}
+
+	target, err := readSymlinkTarget(f)
+	if err != nil {
+		log.Errorf("Readlink: failed reading target of %s: %s", f.Name, err)
+		return nil, fs.ToErrno(err)
+	}
+
+	if _, ok := resolveSymlinkTarget(filepath.Dir(path), target); !ok {
+		log.Errorf("Readlink: refusing %s, its target %s is outside of the project", path, target)
+		return nil, syscall.EPERM
+	}
+
+	return []byte(target), fs.OK
+}
+
+// createReleasedMCFile creates the file name with the given mime type, writes its contents with
+// write, and makes it the current version of the file.
+func (n *Node) createReleasedMCFile(name, mimeType string, write func(underlyingPath string) error) (*mcmodel.File, error) {
+	f, err := n.createNewMCFile(name, mimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	underlyingPath := f.ToUnderlyingFilePath(mcfsRoot)
+	if err := write(underlyingPath); err != nil {
+		deleteFileVersion(f)
+		return nil, err
+	}
+
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(underlyingPath, &st); err != nil {
+		deleteFileVersion(f)
+		return nil, err
+	}
+
+	digests, err := checksumFile(underlyingPath, policy.checksumAlgorithms)
+	if err != nil {
+		deleteFileVersion(f)
+		return nil, err
+	}
+
+	primary := policy.checksumAlgorithms[0]
+	checksum := formatChecksum(primary, digests[primary])
+	if err := transferRequestStore.MarkFileReleased(f, checksum, transferRequest.ProjectID, st.Size); err != nil {
+		deleteFileVersion(f)
+		return nil, err
+	}
+
+	checksumDigests.Store(f.ID, digests)
+	f.Current = true
+	f.Size = uint64(st.Size)
+	f.Checksum = checksum
+
+	return f, nil
+}
+
+// readSymlinkTarget returns the target stored for the symlink f.
+func readSymlinkTarget(f *mcmodel.File) (string, error) {
+	target, err := ioutil.ReadFile(f.ToUnderlyingFilePath(mcfsRoot))
+	if err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+// resolveSymlinkTarget returns the project path that target refers to for a symlink in the
+// directory dirPath. ok is false when target is absolute, or when it climbs above the project root
+// with "..".
+func resolveSymlinkTarget(dirPath, target string) (path string, ok bool) {
+	if target == "" || filepath.IsAbs(target) {
+		return "", false
+	}
+
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				return "", false
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+		}
+	}
+
+	return "/" + strings.Join(parts, "/"), true
+}
+
+// resolveSymlinkChain follows symlinks starting at path until it reaches a file. Directories can't
+// be dereferenced, as that would mean copying the whole tree.
+func resolveSymlinkChain(path string) (*mcmodel.File, syscall.Errno) {
+	for i := 0; i < maxSymlinkHops; i++ {
+		f, err := getEntryByPath(path)
+		switch {
+		case err != nil:
+			return nil, syscall.ENOENT
+		case f.IsDir():
+			return nil, syscall.EPERM
+		case !isSymlink(f):
+			return f, fs.OK
+		}
+
+		target, err := readSymlinkTarget(f)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+
+		var ok bool
+		if path, ok = resolveSymlinkTarget(filepath.Dir(path), target); !ok {
+			return nil, syscall.EPERM
+		}
+	}
+
+	return nil, syscall.ELOOP
+}
+
+// dereferencedLinkNode is the inode returned for a symlink that was dereferenced. It only lives
+// until the kernel looks the name up again, and finds the regular file stored in its place.
+type dereferencedLinkNode struct {
+	fs.Inode
+	target string
+}
+
+var _ = (fs.NodeReadlinker)((*dereferencedLinkNode)(nil))
+
+// Readlink returns the target the link was created with.
+func (n *dereferencedLinkNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return []byte(n.target), fs.OK
+}
@@ -0,0 +1,80 @@
+package mcbridgefs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		dirPath string
+		target  string
+		path    string
+		ok      bool
+	}{
+		{dirPath: "/", target: "file.txt", path: "/file.txt", ok: true},
+		{dirPath: "/d1/d2", target: "../file.txt", path: "/d1/file.txt", ok: true},
+		{dirPath: "/d1/d2", target: "./d3//file.txt", path: "/d1/d2/d3/file.txt", ok: true},
+		{dirPath: "/d1", target: "..", path: "/", ok: true},
+		{dirPath: "/d1", target: "../../file.txt", ok: false},
+		{dirPath: "/", target: "../file.txt", ok: false},
+		{dirPath: "/d1", target: "/etc/passwd", ok: false},
+		{dirPath: "/d1", target: "", ok: false},
+	}
+
+	for _, test := range tests {
+		path, ok := resolveSymlinkTarget(test.dirPath, test.target)
+		require.Equal(t, test.ok, ok, "resolveSymlinkTarget(%s, %s)", test.dirPath, test.target)
+		require.Equal(t, test.path, path, "resolveSymlinkTarget(%s, %s)", test.dirPath, test.target)
+	}
+}
+
+func TestResolveSymlinkChain(t *testing.T) {
+	defer func(root string, cache *PathCache) { mcfsRoot, pathCache = root, cache }(mcfsRoot, pathCache)
+	mcfsRoot = t.TempDir()
+	pathCache = NewPathCache(100, time.Hour)
+
+	file := &mcmodel.File{ID: 1, UUID: "7d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Name: "file.txt", MimeType: "text/plain"}
+	link := &mcmodel.File{ID: 2, UUID: "8d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Name: "link", MimeType: symlinkMimeType}
+	loop := &mcmodel.File{ID: 3, UUID: "9d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Name: "loop", MimeType: symlinkMimeType}
+	escape := &mcmodel.File{ID: 4, UUID: "ad2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Name: "escape", MimeType: symlinkMimeType}
+	dir := &mcmodel.File{ID: 5, UUID: "bd2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Name: "dir", MimeType: "directory"}
+
+	writeBlob(t, mcfsRoot, file, "hello world")
+	writeBlob(t, mcfsRoot, link, "../data/file.txt")
+	writeBlob(t, mcfsRoot, loop, "loop")
+	writeBlob(t, mcfsRoot, escape, "../../file.txt")
+
+	pathCache.Store("/data/file.txt", file)
+	pathCache.Store("/links/link", link)
+	pathCache.Store("/links/loop", loop)
+	pathCache.Store("/links/escape", escape)
+	pathCache.Store("/data/dir", dir)
+	pathCache.Store("/data/missing", nil)
+
+	// A chain of links is followed to the file it ends at, whose contents are stored in its place
+	f, errno := resolveSymlinkChain("/links/link")
+	require.Equal(t, fs.OK, errno)
+	require.Equal(t, file.ID, f.ID)
+
+	f, errno = resolveSymlinkChain("/data/file.txt")
+	require.Equal(t, fs.OK, errno)
+	require.Equal(t, file.ID, f.ID)
+
+	_, errno = resolveSymlinkChain("/links/loop")
+	require.Equal(t, syscall.ELOOP, errno)
+
+	_, errno = resolveSymlinkChain("/links/escape")
+	require.Equal(t, syscall.EPERM, errno, "Links can't be followed outside of the project")
+
+	_, errno = resolveSymlinkChain("/data/dir")
+	require.Equal(t, syscall.EPERM, errno, "Directories can't be dereferenced")
+
+	_, errno = resolveSymlinkChain("/data/missing")
+	require.Equal(t, syscall.ENOENT, errno)
+}
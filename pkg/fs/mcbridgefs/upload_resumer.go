@@ -0,0 +1,273 @@
+package mcbridgefs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/materials-commons/gomcdb/mcmodel"
+)
+
+// UploadResumer lets uploads continue across bridge restarts. The OpenFilesTracker only lives in
+// memory, so when a bridge dies in the middle of a transfer, the versions it was writing to would
+// be left behind, and the retried writes would start new versions. Instead, the state of each
+// version being written is checkpointed to a state file for the transfer request. When a bridge is
+// started again for the same transfer request, opening one of those paths for write resumes the
+// version it was writing to, along with its running checksum.
+//
+// Versions that aren't resumed within the timeout are removed, as the transfer isn't coming back
+// for them. Versions created after the last checkpoint before a crash aren't known, and are left
+// behind.
+type UploadResumer struct {
+	stateDir string
+	interval time.Duration
+	timeout  time.Duration
+
+	// resumable holds the uploads from the previous run of the bridge that haven't been resumed,
+	// keyed by path. mu protects it.
+	mu        sync.Mutex
+	resumable map[string]uploadState
+
+	// lookupVersion loads the version an upload was writing to, when it can still be resumed.
+	lookupVersion func(state uploadState) (*mcmodel.File, error)
+}
+
+// uploadState is the checkpointed state of a version being written.
+type uploadState struct {
+	Path         string `json:"path"`
+	FileID       int    `json:"file_id"`
+	BytesWritten int64  `json:"bytes_written"`
+
+	// Checkpoint is the marshaled state of each checksum, keyed by algorithm. It's empty when the
+	// version wasn't written sequentially, in which case the checksum is computed on release.
+	Checkpoint map[string][]byte `json:"checkpoint,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewUploadResumer creates an UploadResumer that keeps its state files in stateDir, checkpoints
+// every interval and removes versions that haven't been resumed after timeout.
+func NewUploadResumer(stateDir string, interval, timeout time.Duration) *UploadResumer {
+	return &UploadResumer{
+		stateDir:      stateDir,
+		interval:      interval,
+		timeout:       timeout,
+		resumable:     make(map[string]uploadState),
+		lookupVersion: unreleasedVersion,
+	}
+}
+
+// StartUploadResumer loads the uploads that can be resumed for the transfer request and begins
+// checkpointing. It must be called after CreateFS.
+func StartUploadResumer(ctx context.Context) {
+	uploadResumer.Start(ctx)
+}
+
+// Start loads the uploads left by a previous run of the bridge, and starts checkpointing the
+// versions being written. An UploadResumer with an interval of zero doesn't do anything.
+func (r *UploadResumer) Start(ctx context.Context) {
+	if r.interval <= 0 {
+		return
+	}
+
+	if err := os.MkdirAll(r.stateDir, 0700); err != nil {
+		log.Errorf("Unable to start upload resumer: %s", err)
+		return
+	}
+
+	if err := r.load(); err != nil {
+		log.Errorf("Failed loading upload state from %s: %s", r.stateFilePath(), err)
+	}
+
+	r.removeStale()
+
+	log.Info("Starting upload resumer...")
+	go r.checkpointUploads(ctx)
+}
+
+func (r *UploadResumer) checkpointUploads(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			r.save()
+			log.Infof("Shutting down upload resumer")
+			return
+		case <-time.After(r.interval):
+		}
+
+		r.removeStale()
+		r.save()
+	}
+}
+
+// resumeUpload opens the version the upload to path was writing to before the bridge was restarted,
+// with the flags and mode of the create or open being retried. It returns a nil OpenFile when there
+// isn't an upload to resume.
+func resumeUpload(path string, flags, mode uint32) (*OpenFile, int, error) {
+	openFile := uploadResumer.Resume(path)
+	if openFile == nil {
+		return nil, -1, nil
+	}
+
+	fd, err := syscall.Open(openFile.File.ToUnderlyingFilePath(mcfsRoot), int(flags)|os.O_CREATE, mode)
+	if err != nil {
+		openedFilesTracker.Release(openFile)
+		return nil, -1, err
+	}
+
+	if flags&syscall.O_TRUNC != 0 {
+		openFile.recordTruncate(0)
+	}
+
+	return openFile, fd, nil
+}
+
+// Resume returns the tracker entry for the version being written at path before the bridge was
+// restarted, or nil if there isn't one. The caller holds the first reference to the entry.
+func (r *UploadResumer) Resume(path string) *OpenFile {
+	r.mu.Lock()
+	state, ok := r.resumable[path]
+	delete(r.resumable, path)
+	r.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	version, err := r.lookupVersion(state)
+	switch {
+	case err != nil:
+		log.Errorf("Failed loading version %d to resume %s: %s", state.FileID, path, err)
+		return nil
+	case version == nil || version.Name != filepath.Base(path):
+		// The version was finished, removed or moved by someone else
+		return nil
+	}
+
+	openFile := openedFilesTracker.Store(path, version)
+	openFile.resume(state)
+
+	log.Infof("Resuming upload of %s into version %d at %d bytes", path, state.FileID, state.BytesWritten)
+	return openFile
+}
+
+// load reads the uploads to resume from the state file.
+func (r *UploadResumer) load() error {
+	data, err := ioutil.ReadFile(r.stateFilePath())
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	var states []uploadState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, state := range states {
+		r.resumable[state.Path] = state
+	}
+
+	return nil
+}
+
+// save writes the state of the versions being written, and of the uploads that can still be
+// resumed, to the state file. The file is replaced atomically so that a crash while saving doesn't
+// lose the previous checkpoint.
+func (r *UploadResumer) save() {
+	states := openedFilesTracker.Checkpoint()
+
+	r.mu.Lock()
+	for _, state := range r.resumable {
+		states = append(states, state)
+	}
+	r.mu.Unlock()
+
+	data, err := json.Marshal(states)
+	if err != nil {
+		log.Errorf("Failed saving upload state: %s", err)
+		return
+	}
+
+	tmpPath := r.stateFilePath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		log.Errorf("Failed saving upload state to %s: %s", tmpPath, err)
+		return
+	}
+
+	if err := os.Rename(tmpPath, r.stateFilePath()); err != nil {
+		log.Errorf("Failed saving upload state to %s: %s", r.stateFilePath(), err)
+	}
+}
+
+// removeStale removes the versions for uploads that weren't resumed within the timeout.
+func (r *UploadResumer) removeStale() {
+	var stale []uploadState
+
+	r.mu.Lock()
+	for path, state := range r.resumable {
+		if time.Since(state.UpdatedAt) > r.timeout {
+			stale = append(stale, state)
+			delete(r.resumable, path)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, state := range stale {
+		version, err := r.lookupVersion(state)
+		if err != nil {
+			log.Errorf("Failed loading stale version %d of %s: %s", state.FileID, state.Path, err)
+			continue
+		}
+
+		if version != nil {
+			log.Infof("Removing version %d of %s, its upload wasn't resumed", state.FileID, state.Path)
+			deleteFileVersion(version)
+		}
+	}
+}
+
+// unreleasedVersion returns the version for the upload state, as long as it's still a version this
+// transfer request was writing to that never got released, or nil if it isn't. Versions with a
+// checksum, or that share a blob, were released. Versions whose release is journaled but didn't
+// finish are left for the release recovery, as their uploads completed.
+func unreleasedVersion(state uploadState) (*mcmodel.File, error) {
+	if releaseJournal.IsUnfinished(state.FileID) {
+		return nil, nil
+	}
+
+	transferRequestFileIDs := db.Model(&mcmodel.TransferRequestFile{}).
+		Select("file_id").
+		Where("transfer_request_id = ?", transferRequest.ID)
+
+	var versions []mcmodel.File
+	err := db.Where("id = ?", state.FileID).
+		Where("current = ?", false).
+		Where("deleted_at IS NULL").
+		Where("id in (?)", transferRequestFileIDs).
+		Find(&versions).Error
+	switch {
+	case err != nil:
+		return nil, err
+	case len(versions) == 0 || versions[0].Checksum != "" || versions[0].UsesUUID != "":
+		return nil, nil
+	}
+
+	return &versions[0], nil
+}
+
+func (r *UploadResumer) stateFilePath() string {
+	return filepath.Join(r.stateDir, fmt.Sprintf("transfer-request-%d.json", transferRequest.ID))
+}
@@ -0,0 +1,57 @@
+package mcbridgefs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeUploadAfterRestart(t *testing.T) {
+	defer func(root string, tracker *OpenFilesTracker, resumer *UploadResumer) {
+		mcfsRoot, openedFilesTracker, uploadResumer = root, tracker, resumer
+	}(mcfsRoot, openedFilesTracker, uploadResumer)
+
+	mcfsRoot = t.TempDir()
+	stateDir := t.TempDir()
+	version := mcmodel.File{ID: 7, UUID: "6d2f1d5c-7e3a-4f1b-9c4e-5a6b7c8d9e0f", Name: "file.txt"}
+	blobPath := version.ToUnderlyingFilePath(mcfsRoot)
+
+	// The bridge writes part of the file and checkpoints it before dying
+	openedFilesTracker = NewOpenFilesTracker()
+	writeBlob(t, mcfsRoot, &version, "")
+	writeAt(t, openedFilesTracker.Store("/dir/file.txt", &version), blobPath, []byte("hello "), 0)
+	NewUploadResumer(stateDir, time.Second, time.Hour).save()
+
+	// The restarted bridge has an empty tracker, and loads the checkpoint
+	openedFilesTracker = NewOpenFilesTracker()
+	uploadResumer = NewUploadResumer(stateDir, time.Second, time.Hour)
+	uploadResumer.lookupVersion = func(state uploadState) (*mcmodel.File, error) {
+		require.Equal(t, version.ID, state.FileID)
+		f := version
+		return &f, nil
+	}
+	require.NoError(t, uploadResumer.load())
+
+	// The retried create continues the same version, along with its checksum
+	openFile, fd, err := resumeUpload("/dir/file.txt", syscall.O_WRONLY|syscall.O_CREAT, 0644)
+	require.NoError(t, err)
+	require.NotNil(t, openFile, "The create should resume the upload")
+	require.Equal(t, version.ID, openFile.File.ID)
+	require.Equal(t, openFile, openedFilesTracker.Get("/dir/file.txt"))
+
+	n, err := syscall.Pwrite(fd, []byte("world"), 6)
+	require.NoError(t, err)
+	openFile.recordWrite([]byte("world")[:n], 6)
+	require.NoError(t, syscall.Close(fd))
+
+	require.True(t, openFile.sequential, "The checksum should continue from the checkpoint")
+	require.Equal(t, expectedChecksum(t, blobPath), finalChecksum(t, openFile, blobPath))
+
+	openedFilesTracker.Release(openFile)
+	openFile, _, err = resumeUpload("/dir/file.txt", syscall.O_WRONLY|syscall.O_CREAT, 0644)
+	require.NoError(t, err)
+	require.Nil(t, openFile, "An upload is only resumed once")
+}
@@ -1,49 +1,340 @@
 package mcbridgefs
 
 import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/apex/log"
 	"github.com/materials-commons/gomcdb/mcmodel"
+	"gorm.io/gorm"
 )
 
-func getDirectoriesToUpdate(dir mcmodel.File, newName string) {
-	directoriesToUpdate := getAllDescendents(dir)
-	for _, dir2 := range directoriesToUpdate {
-		dir2.Path = strings.Replace(dir2.Path, dir.Name, newName, 1)
+// getDirectoriesToUpdate returns all the descendant directories of dir with their paths rewritten
+// to be under newPath. It doesn't update the database.
+func getDirectoriesToUpdate(tx *gorm.DB, dir *mcmodel.File, newPath string) ([]*mcmodel.File, error) {
+	directoriesToUpdate, err := getAllDescendents(tx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only replace the leading dir.Path. A plain string replace would also rewrite any later
+	// path component that happens to match.
+	for _, descendant := range directoriesToUpdate {
+		descendant.Path = newPath + strings.TrimPrefix(descendant.Path, dir.Path)
+	}
+
+	return directoriesToUpdate, nil
+}
+
+// getAllDescendents returns all the directories below dir. It walks the tree one level at a time,
+// finding the directories whose parent is in the previous level.
+func getAllDescendents(tx *gorm.DB, dir *mcmodel.File) ([]*mcmodel.File, error) {
+	var descendents []*mcmodel.File
+	parentIDs := []int{dir.ID}
+
+	for len(parentIDs) != 0 {
+		var dirs []*mcmodel.File
+		err := tx.Where("directory_id in ?", parentIDs).
+			Where("project_id = ?", dir.ProjectID).
+			Where("mime_type = ?", "directory").
+			Where("deleted_at IS NULL").
+			Find(&dirs).Error
+		if err != nil {
+			return nil, err
+		}
+
+		parentIDs = make([]int, 0, len(dirs))
+		for _, d := range dirs {
+			descendents = append(descendents, d)
+			parentIDs = append(parentIDs, d.ID)
+		}
+	}
+
+	return descendents, nil
+}
+
+// getCurrentEntryInDir finds the current file or directory called name in the directory with id dirID.
+func getCurrentEntryInDir(dirID int, name string) (*mcmodel.File, error) {
+	var f mcmodel.File
+	err := db.Preload("Directory").
+		Where("directory_id = ?", dirID).
+		Where("project_id = ?", transferRequest.ProjectID).
+		Where("name = ?", name).
+		Where("current = ?", true).
+		Where("deleted_at IS NULL").
+		First(&f).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// getEntryInDir finds the entry called name in dir. A file created during this transfer request
+// doesn't have a current version until it is released, so when there is no current entry the
+// version being written to is returned.
+func getEntryInDir(dir *mcmodel.File, name string) (*mcmodel.File, error) {
+	f, err := getCurrentEntryInDir(dir.ID, name)
+	if err == nil {
+		return f, nil
+	}
+
+	if inProgress := getFromOpenedFiles(filepath.Join(dir.Path, name)); inProgress != nil {
+		return inProgress, nil
+	}
+
+	return nil, err
+}
+
+// softDeleteFiles marks the files with the given ids as deleted. Soft deleted files are no longer
+// current, so they won't show up in listings.
+func softDeleteFiles(tx *gorm.DB, ids ...int) error {
+	return tx.Model(&mcmodel.File{}).
+		Where("id in ?", ids).
+		Updates(map[string]interface{}{"deleted_at": time.Now(), "current": false}).Error
+}
+
+// softDeleteFileVersions marks every version of the file name in the directory with id dirID as
+// deleted, including any still being written to.
+func softDeleteFileVersions(tx *gorm.DB, dirID int, name string) error {
+	return tx.Model(&mcmodel.File{}).
+		Where("directory_id = ?", dirID).
+		Where("name = ?", name).
+		Where("mime_type <> ?", "directory").
+		Where("deleted_at IS NULL").
+		Updates(map[string]interface{}{"deleted_at": time.Now(), "current": false}).Error
+}
+
+// deleteFileVersion removes a file version that was created but couldn't be used, such as when its
+// underlying file couldn't be created or opened, or that turned out to be identical to the current
+// version. The version never became current, so both its database rows and its underlying file are
+// removed rather than soft deleting it. Otherwise it would show up as a previous version of the file.
+// The underlying file is kept when its contents are shared with other files.
+func deleteFileVersion(f *mcmodel.File) {
+	err := withTxRetry(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id = ?", f.ID).Delete(&mcmodel.TransferRequestFile{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&mcmodel.File{}, f.ID).Error
+	}, db, txRetryCount)
+
+	if err != nil {
+		log.Errorf("Failed removing file version %d of %s: %s", f.ID, f.Name, err)
+	}
+
+	checksumDigests.Delete(f.ID)
+
+	if shared, err := sharesBlob(f); err != nil || shared {
+		log.Infof("Not removing underlying file for version %d of %s, its contents may be shared", f.ID, f.Name)
+		return
+	}
+
+	if err := os.Remove(f.ToUnderlyingFilePath(mcfsRoot)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed removing underlying file for version %d of %s: %s", f.ID, f.Name, err)
+	}
+}
+
+// copyFileContents replaces the contents of the file at dstPath with the contents of the file at
+// srcPath. The file is cloned when the underlying file system supports reflinks. Otherwise it's
+// copied with io.Copy, which uses copy_file_range so the data doesn't pass through the bridge.
+func copyFileContents(dstPath, srcPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if err := cloneFile(int(dst.Fd()), int(src.Fd())); err == nil {
+		return dst.Close()
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
 	}
+
+	return dst.Close()
 }
 
-func getAllDescendents(dir mcmodel.File) map[string]*mcmodel.File {
-	directoriesToUpdate := make(map[string]*mcmodel.File)
-	count := 0
+// errDirNotEmpty is returned when a directory can't be removed because it still has entries.
+var errDirNotEmpty = errors.New("directory not empty")
+
+// softDeleteDirs marks the directories with the given ids, and every entry directly in them, as
+// deleted. Versions that other transfer requests are still writing to are left alone, they belong
+// to those bridges.
+func softDeleteDirs(tx *gorm.DB, dirIDs ...int) error {
+	otherTransferRequestFileIDs := tx.Model(&mcmodel.TransferRequestFile{}).
+		Select("file_id").
+		Where("transfer_request_id <> ?", transferRequest.ID).
+		Where("directory_id in ?", dirIDs)
+
+	err := tx.Model(&mcmodel.File{}).
+		Where("directory_id in ?", dirIDs).
+		Where("deleted_at IS NULL").
+		Where("id not in (?)", otherTransferRequestFileIDs).
+		Updates(map[string]interface{}{"deleted_at": time.Now(), "current": false}).Error
+	if err != nil {
+		return err
+	}
+
+	return softDeleteFiles(tx, dirIDs...)
+}
 
-	var dirs []mcmodel.File
-	err := db.Where("directory_id = ?", dir.ID).
-		Raw("where path is not null").
-		Find(&dirs).Error
+// isDirEmpty returns true when dir has no current entries, and no files being written to in it.
+func isDirEmpty(tx *gorm.DB, dir *mcmodel.File) (bool, error) {
+	var currentCount int64
+	err := tx.Model(&mcmodel.File{}).
+		Where("directory_id = ?", dir.ID).
+		Where("current = ?", true).
+		Where("deleted_at IS NULL").
+		Count(&currentCount).Error
 	if err != nil {
-		return directoriesToUpdate
+		return false, err
 	}
 
-	for {
-		var ids []int
-		for _, dir2 := range dirs {
-			directoriesToUpdate[dir2.UUID] = &dir2
-			ids = append(ids, dir2.ID)
+	return currentCount == 0 && len(openedFilesTracker.PathsUnder(dir.Path)) == 0, nil
+}
+
+// softDeleteCreatedSubtree marks dir and everything below it as deleted. Only entries created
+// during this transfer request can be removed this way, so errDirNotEmpty is returned when
+// any current entry in the subtree existed before the transfer request.
+func softDeleteCreatedSubtree(tx *gorm.DB, dir *mcmodel.File) error {
+	descendents, err := getAllDescendents(tx, dir)
+	if err != nil {
+		return err
+	}
+
+	dirIDs := []int{dir.ID}
+	dirPaths := map[int]string{dir.ID: dir.Path}
+	for _, d := range descendents {
+		if !createdFilesTracker.Has(d.Path) {
+			return errDirNotEmpty
 		}
-		if len(directoriesToUpdate) == count {
-			break
+		dirIDs = append(dirIDs, d.ID)
+		dirPaths[d.ID] = d.Path
+	}
+
+	var files []mcmodel.File
+	err = tx.Where("directory_id in ?", dirIDs).
+		Where("mime_type <> ?", "directory").
+		Where("current = ?", true).
+		Where("deleted_at IS NULL").
+		Find(&files).Error
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !createdFilesTracker.Has(filepath.Join(dirPaths[f.DirectoryID], f.Name)) {
+			return errDirNotEmpty
 		}
+	}
 
-		count = len(directoriesToUpdate)
+	return softDeleteDirs(tx, dirIDs...)
+}
 
-		err = db.Where("directory_id in ?", ids).
-			Raw("where path is not null").
-			Find(&dirs).Error
-		if err != nil {
-			break
+// getDirChildCounts returns the number of current entries in a directory, and how many of those
+// are directories.
+func getDirChildCounts(dirID int) (entries int64, subdirs int64, err error) {
+	var counts struct {
+		Entries int64
+		Subdirs int64
+	}
+
+	err = db.Model(&mcmodel.File{}).
+		Select("COUNT(*) AS entries, COALESCE(SUM(CASE WHEN mime_type = 'directory' THEN 1 ELSE 0 END), 0) AS subdirs").
+		Where("directory_id = ?", dirID).
+		Where("current = ?", true).
+		Where("deleted_at IS NULL").
+		Scan(&counts).Error
+
+	return counts.Entries, counts.Subdirs, err
+}
+
+// touchDirs advances the updated_at time of directories whose entries were changed by the bridge,
+// so that their modification time reflects the change.
+func touchDirs(tx *gorm.DB, dirIDs ...int) error {
+	return tx.Model(&mcmodel.File{}).
+		Where("id in ?", dirIDs).
+		UpdateColumn("updated_at", time.Now()).Error
+}
+
+// touchParentDirs is touchDirs for changes that were made outside a transaction. A failure only
+// leaves the modification time stale, so it is logged rather than returned.
+func touchParentDirs(dirIDs ...int) {
+	err := withTxRetry(func(tx *gorm.DB) error {
+		return touchDirs(tx, dirIDs...)
+	}, db, txRetryCount)
+
+	if err != nil {
+		log.Errorf("Failed updating modification time for directories %v: %s", dirIDs, err)
+	}
+}
+
+// getDirByPath returns the directory at path, using the path cache when it can.
+func getDirByPath(path string) (*mcmodel.File, error) {
+	if dir, ok := pathCache.Get(path); ok {
+		if dir == nil {
+			return nil, gorm.ErrRecordNotFound
+		}
+
+		return dir, nil
+	}
+
+	dir, err := fileStore.GetDirByPath(transferRequest.ProjectID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	pathCache.Store(path, dir)
+	return dir, nil
+}
+
+// getEntryByPath returns the current file or directory at path. The parent directory is resolved
+// through the path cache, so only the entry itself is queried for. Directories, and paths where
+// nothing exists, are added to the cache.
+func getEntryByPath(path string) (*mcmodel.File, error) {
+	if path == "/" {
+		return getDirByPath(path)
+	}
+
+	if dir, ok := pathCache.Get(path); ok {
+		if dir == nil {
+			return nil, gorm.ErrRecordNotFound
 		}
+
+		return dir, nil
 	}
 
-	return directoriesToUpdate
+	parent, err := getDirByPath(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := getCurrentEntryInDir(parent.ID, filepath.Base(path))
+	switch {
+	case err == nil && f.IsDir():
+		pathCache.Store(path, f)
+	case errors.Is(err, gorm.ErrRecordNotFound) && getFromOpenedFiles(path) == nil:
+		// Nothing exists at path, unless it's a file being written in this transfer request, which
+		// doesn't have a current version yet.
+		pathCache.Store(path, nil)
+	}
+
+	return f, err
+}
+
+// GetPathCacheStats returns the hit and miss counts for the bridge's path cache.
+func GetPathCacheStats() PathCacheStats {
+	return pathCache.Stats()
 }
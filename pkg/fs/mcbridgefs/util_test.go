@@ -0,0 +1,26 @@
+package mcbridgefs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyFileContents(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	require.NoError(t, ioutil.WriteFile(src, []byte("current version"), 0644))
+	require.NoError(t, ioutil.WriteFile(dst, []byte("stale contents that are longer"), 0644))
+
+	require.NoError(t, copyFileContents(dst, src))
+
+	contents, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "current version", string(contents))
+
+	require.Error(t, copyFileContents(dst, filepath.Join(dir, "missing")))
+}
@@ -0,0 +1,350 @@
+package mcbridgefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/materials-commons/mcbridgefs/pkg/fs/bridgefs"
+	"gorm.io/gorm"
+)
+
+// versionsDirName is the name of the hidden virtual directory, available in every directory, that
+// exposes the previous versions of the files in that directory. The layout is
+// .versions/<filename>/<timestamp>-<id>-<filename>. The contents of the versions are immutable.
+// Writing to a version promotes it back to being the current version of the file, and what was
+// written is discarded, eg "echo > .versions/a.txt/<version>".
+const versionsDirName = ".versions"
+
+// versionsDirNode is the .versions directory. It contains a directory for each file in dir that
+// has previous versions.
+type versionsDirNode struct {
+	fs.Inode
+	dir *Node
+}
+
+var _ = (fs.NodeReaddirer)((*versionsDirNode)(nil))
+var _ = (fs.NodeLookuper)((*versionsDirNode)(nil))
+var _ = (fs.NodeGetattrer)((*versionsDirNode)(nil))
+
+// versionsFileDirNode is the directory in .versions for a single file. It contains an entry for
+// each previous version of the file.
+type versionsFileDirNode struct {
+	fs.Inode
+	dir  *Node
+	name string
+}
+
+var _ = (fs.NodeReaddirer)((*versionsFileDirNode)(nil))
+var _ = (fs.NodeLookuper)((*versionsFileDirNode)(nil))
+var _ = (fs.NodeGetattrer)((*versionsFileDirNode)(nil))
+
+// versionNode is a single previous version of a file.
+type versionNode struct {
+	fs.Inode
+	dir  *Node
+	file *mcmodel.File
+}
+
+var _ = (fs.NodeOpener)((*versionNode)(nil))
+var _ = (fs.NodeGetattrer)((*versionNode)(nil))
+var _ = (fs.NodeSetattrer)((*versionNode)(nil))
+
+// lookupVersionsDir returns the inode for the .versions directory in n.
+func (n *Node) lookupVersionsDir(ctx context.Context, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	setVirtualDirAttr(&out.Attr)
+	return n.NewInode(ctx, &versionsDirNode{dir: n}, fs.StableAttr{Mode: syscall.S_IFDIR}), fs.OK
+}
+
+// Readdir lists the files that have previous versions.
+func (n *versionsDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	dir, err := n.dir.getMCDir("")
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+
+	var names []string
+	err = previousVersionsQuery(db, dir.ID).Distinct("name").Order("name").Pluck("name", &names).Error
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: syscall.S_IFDIR})
+	}
+
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *versionsDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	versions, errno := getPreviousVersions(n.dir, name)
+	switch {
+	case errno != fs.OK:
+		return nil, errno
+	case len(versions) == 0:
+		return nil, syscall.ENOENT
+	}
+
+	setVirtualDirAttr(&out.Attr)
+	return n.NewInode(ctx, &versionsFileDirNode{dir: n.dir, name: name}, fs.StableAttr{Mode: syscall.S_IFDIR}), fs.OK
+}
+
+func (n *versionsDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setVirtualDirAttr(&out.Attr)
+	return fs.OK
+}
+
+// Readdir lists the previous versions of the file.
+func (n *versionsFileDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	versions, errno := getPreviousVersions(n.dir, n.name)
+	if errno != fs.OK {
+		return nil, errno
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(versions))
+	for i := range versions {
+		entries = append(entries, fuse.DirEntry{Name: versionEntryName(&versions[i]), Mode: syscall.S_IFREG})
+	}
+
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *versionsFileDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	versions, errno := getPreviousVersions(n.dir, n.name)
+	if errno != fs.OK {
+		return nil, errno
+	}
+
+	for i := range versions {
+		if versionEntryName(&versions[i]) != name {
+			continue
+		}
+
+		node := &versionNode{dir: n.dir, file: &versions[i]}
+		if errno := node.getattr(&out.Attr); errno != fs.OK {
+			return nil, errno
+		}
+
+		return n.NewInode(ctx, node, fs.StableAttr{Mode: syscall.S_IFREG}), fs.OK
+	}
+
+	return nil, syscall.ENOENT
+}
+
+func (n *versionsFileDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setVirtualDirAttr(&out.Attr)
+	return fs.OK
+}
+
+// Open opens the version. The contents of a version are never modified, so the underlying file is
+// always opened for reading. Opening it for write returns a handle that promotes the version when
+// it's written to, or truncated.
+func (n *versionNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	fd, err := syscall.Open(n.file.ToUnderlyingFilePath(mcfsRoot), syscall.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+
+	bridgeFH := bridgefs.NewBridgeFileHandle(fd).(*bridgefs.BridgeFileHandle)
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return &readOnlyFileHandle{BridgeFileHandle: bridgeFH}, 0, fs.OK
+	}
+
+	return &promoteFileHandle{BridgeFileHandle: bridgeFH, version: n}, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+func (n *versionNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return n.getattr(&out.Attr)
+}
+
+// Setattr fails because versions are immutable. Truncating a version opened for write, such as
+// when a shell redirects into it, promotes it instead.
+func (n *versionNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	fh, ok := f.(*promoteFileHandle)
+	if _, truncate := in.GetSize(); !ok || !truncate {
+		return syscall.EROFS
+	}
+
+	if errno := fh.promote(); errno != fs.OK {
+		return errno
+	}
+
+	return n.getattr(&out.Attr)
+}
+
+func (n *versionNode) getattr(out *fuse.Attr) syscall.Errno {
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(n.file.ToUnderlyingFilePath(mcfsRoot), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+
+	out.FromStat(&st)
+	out.Mode = syscall.S_IFREG | 0444
+	out.Uid = uid
+	out.Gid = gid
+	return fs.OK
+}
+
+// promote makes the version the current version of its file. It fails with ENOENT when the version
+// was removed since it was looked up.
+func (n *versionNode) promote() syscall.Errno {
+	err := withTxRetry(func(tx *gorm.DB) error {
+		err := tx.Model(&mcmodel.File{}).
+			Where("directory_id = ?", n.file.DirectoryID).
+			Where("project_id = ?", transferRequest.ProjectID).
+			Where("name = ?", n.file.Name).
+			Where("mime_type <> ?", "directory").
+			Where("current = ?", true).
+			Where("deleted_at IS NULL").
+			Update("current", false).Error
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&mcmodel.File{}).
+			Where("id = ?", n.file.ID).
+			Where("project_id = ?", transferRequest.ProjectID).
+			Where("deleted_at IS NULL").
+			Update("current", true)
+		switch {
+		case result.Error != nil:
+			return result.Error
+		case result.RowsAffected == 0:
+			return gorm.ErrRecordNotFound
+		}
+
+		return nil
+	}, db, txRetryCount)
+
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return syscall.ENOENT
+	case err != nil:
+		log.Errorf("Failed promoting version %d of %s: %s", n.file.ID, n.file.Name, err)
+		return syscall.EIO
+	}
+
+	// The entry in the real directory now refers to a different version.
+	n.dir.invalidateCaches(n.file.Name)
+	go n.dir.NotifyEntry(n.file.Name)
+
+	return fs.OK
+}
+
+// readOnlyFileHandle is the file handle for a version. It rejects all modifications.
+type readOnlyFileHandle struct {
+	*bridgefs.BridgeFileHandle
+}
+
+func (f *readOnlyFileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	return 0, syscall.EROFS
+}
+
+func (f *readOnlyFileHandle) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return syscall.EROFS
+}
+
+func (f *readOnlyFileHandle) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	return syscall.EROFS
+}
+
+// promoteFileHandle is the file handle for a version opened for write. Writing to it promotes the
+// version, once, and discards the data written.
+type promoteFileHandle struct {
+	*bridgefs.BridgeFileHandle
+	version *versionNode
+
+	mu       sync.Mutex
+	promoted bool
+}
+
+func (f *promoteFileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if errno := f.promote(); errno != fs.OK {
+		return 0, errno
+	}
+
+	return uint32(len(data)), fs.OK
+}
+
+func (f *promoteFileHandle) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	return syscall.EROFS
+}
+
+// promote promotes the version the first time it's called.
+func (f *promoteFileHandle) promote() syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.promoted {
+		return fs.OK
+	}
+
+	if errno := f.version.promote(); errno != fs.OK {
+		return errno
+	}
+
+	f.promoted = true
+	return fs.OK
+}
+
+// getPreviousVersions returns the previous versions of the file name in the directory for dirNode,
+// newest first.
+func getPreviousVersions(dirNode *Node, name string) ([]mcmodel.File, syscall.Errno) {
+	dir, err := dirNode.getMCDir("")
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+
+	var versions []mcmodel.File
+	if err := previousVersionsQuery(db, dir.ID).Where("name = ?", name).Order("id desc").Find(&versions).Error; err != nil {
+		return nil, syscall.EIO
+	}
+
+	return versions, fs.OK
+}
+
+// previousVersionsQuery builds the query for the previous versions of the files in a directory.
+// Only released versions are previous versions. Versions that are still being written, by this
+// bridge or by another open transfer, have no checksum yet and belong to an open transfer.
+func previousVersionsQuery(tx *gorm.DB, dirID int) *gorm.DB {
+	openTransferRequestIDs := tx.Model(&mcmodel.TransferRequest{}).Select("id").Where("state = ?", "open")
+	openTransferFileIDs := tx.Model(&mcmodel.TransferRequestFile{}).
+		Select("file_id").
+		Where("transfer_request_id in (?)", openTransferRequestIDs)
+
+	query := tx.Model(&mcmodel.File{}).
+		Where("directory_id = ?", dirID).
+		Where("project_id = ?", transferRequest.ProjectID).
+		Where("mime_type <> ?", "directory").
+		Where("current = ?", false).
+		Where("deleted_at IS NULL").
+		Where("(checksum <> ? OR id not in (?))", "", openTransferFileIDs)
+
+	if ids := openedFilesTracker.FileIDs(); len(ids) != 0 {
+		query = query.Where("id not in ?", ids)
+	}
+
+	return query
+}
+
+// versionEntryName is the name of a version in .versions/<filename>.
+func versionEntryName(f *mcmodel.File) string {
+	return fmt.Sprintf("%s-%d-%s", f.CreatedAt.UTC().Format("20060102T150405Z"), f.ID, f.Name)
+}
+
+// setVirtualDirAttr sets the attributes for the read only .versions directories.
+func setVirtualDirAttr(out *fuse.Attr) {
+	now := time.Now()
+	out.Mode = syscall.S_IFDIR | 0555
+	out.Uid = uid
+	out.Gid = gid
+	out.SetTimes(&now, &now, &now)
+}
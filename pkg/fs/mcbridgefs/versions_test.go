@@ -0,0 +1,34 @@
+package mcbridgefs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionEntryName(t *testing.T) {
+	f := &mcmodel.File{
+		ID:        123,
+		Name:      "data.csv",
+		CreatedAt: time.Date(2022, 5, 18, 20, 9, 30, 0, time.UTC),
+	}
+
+	require.Equal(t, "20220518T200930Z-123-data.csv", versionEntryName(f))
+}
+
+func TestVersionNodeIsImmutable(t *testing.T) {
+	n := &versionNode{file: &mcmodel.File{ID: 1, Name: "data.csv"}}
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	require.Equal(t, syscall.EROFS, n.Setattr(context.Background(), nil, in, &fuse.AttrOut{}), "Only write handles can promote a version")
+
+	fh := &readOnlyFileHandle{}
+	_, errno := fh.Write(context.Background(), []byte("data"), 0)
+	require.Equal(t, syscall.EROFS, errno)
+}
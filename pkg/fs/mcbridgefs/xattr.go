@@ -0,0 +1,357 @@
+package mcbridgefs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"golang.org/x/sys/unix"
+	"gorm.io/gorm"
+)
+
+// mcXattrPrefix is the prefix for the extended attributes that expose the Materials Commons
+// metadata for a file or directory.
+const mcXattrPrefix = "user.mc."
+
+// checksumXattrPrefix is the prefix for the extended attributes that return the digest of a file
+// for a checksum algorithm, eg user.mc.checksum.sha256.
+const checksumXattrPrefix = mcXattrPrefix + "checksum."
+
+// attrXattrPrefix and tagXattrPrefix are the prefixes for the writable extended attributes. These
+// map to the Materials Commons attributes and tags on a file, eg user.mc.attr.temperature and
+// user.mc.tag.calibrated.
+const (
+	attrXattrPrefix = mcXattrPrefix + "attr."
+	tagXattrPrefix  = mcXattrPrefix + "tag."
+)
+
+// mcXattrs are the read only extended attributes available on every file and directory. Each
+// attribute maps to a function that computes its value from the Materials Commons entry.
+var mcXattrs = map[string]func(f *mcmodel.File) (string, error){
+	"uuid":          func(f *mcmodel.File) (string, error) { return f.UUID, nil },
+	"id":            func(f *mcmodel.File) (string, error) { return strconv.Itoa(f.ID), nil },
+	"project_id":    func(f *mcmodel.File) (string, error) { return strconv.Itoa(f.ProjectID), nil },
+	"checksum":      func(f *mcmodel.File) (string, error) { return f.Checksum, nil },
+	"mime_type":     func(f *mcmodel.File) (string, error) { return f.MimeType, nil },
+	"owner_id":      func(f *mcmodel.File) (string, error) { return strconv.Itoa(f.OwnerID), nil },
+	"version_count": getVersionCountXattr,
+	"current":       func(f *mcmodel.File) (string, error) { return strconv.FormatBool(f.Current), nil },
+	"created_at":    func(f *mcmodel.File) (string, error) { return f.CreatedAt.Format(time.RFC3339), nil },
+	"updated_at":    func(f *mcmodel.File) (string, error) { return f.UpdatedAt.Format(time.RFC3339), nil },
+}
+
+// mcXattrNames is the sorted list of the mcXattrs names, so that Listxattr is stable.
+var mcXattrNames = func() []string {
+	var names []string
+	for name := range mcXattrs {
+		names = append(names, mcXattrPrefix+name)
+	}
+	sort.Strings(names)
+	return names
+}()
+
+// Getxattr returns the extended attributes the bridge provides. These are read only and are
+// computed from the Materials Commons entry. Any other attribute doesn't exist.
+func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if !strings.HasPrefix(attr, mcXattrPrefix) {
+		return 0, syscall.ENODATA
+	}
+
+	entry, err := n.getMCEntry()
+	if err != nil {
+		return 0, syscall.ENOENT
+	}
+
+	var value string
+	switch {
+	case strings.HasPrefix(attr, checksumXattrPrefix):
+		algorithm := strings.TrimPrefix(attr, checksumXattrPrefix)
+		if _, ok := checksumConstructors[algorithm]; !ok || entry.IsDir() {
+			return 0, syscall.ENODATA
+		}
+
+		digest, ok := getDigest(entry, algorithm)
+		if !ok {
+			return 0, syscall.ENODATA
+		}
+
+		return copyXattrValue([]byte(digest), dest)
+
+	case strings.HasPrefix(attr, attrXattrPrefix):
+		attrs, err := getFileAttributes(entry.ID)
+		if err != nil {
+			return 0, syscall.EIO
+		}
+
+		value, ok := attrs[strings.TrimPrefix(attr, attrXattrPrefix)]
+		if !ok {
+			return 0, syscall.ENODATA
+		}
+
+		return copyXattrValue([]byte(value), dest)
+
+	case strings.HasPrefix(attr, tagXattrPrefix):
+		tags, err := getFileTags(entry.ID)
+		if err != nil {
+			return 0, syscall.EIO
+		}
+
+		for _, t := range tags {
+			if t == strings.TrimPrefix(attr, tagXattrPrefix) {
+				// Tags don't have a value
+				return 0, fs.OK
+			}
+		}
+
+		return 0, syscall.ENODATA
+	}
+
+	valueFn, ok := mcXattrs[strings.TrimPrefix(attr, mcXattrPrefix)]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+
+	if value, err = valueFn(entry); err != nil {
+		log.Errorf("Getxattr: failed getting %s for %s: %s", attr, entry.FullPath(), err)
+		return 0, syscall.EIO
+	}
+
+	return copyXattrValue([]byte(value), dest)
+}
+
+// Listxattr lists the extended attributes the bridge provides for the node, along with the
+// attributes and tags on the Materials Commons entry. Checksums are only listed for the
+// algorithms whose digest can be read.
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	entry, err := n.getMCEntry()
+	if err != nil {
+		return 0, syscall.ENOENT
+	}
+
+	names := append([]string{}, mcXattrNames...)
+	for _, algorithm := range digestAlgorithms(entry) {
+		names = append(names, checksumXattrPrefix+algorithm)
+	}
+
+	attrs, err := getFileAttributes(entry.ID)
+	if err != nil {
+		return 0, syscall.EIO
+	}
+
+	var attrNames []string
+	for name := range attrs {
+		attrNames = append(attrNames, attrXattrPrefix+name)
+	}
+	sort.Strings(attrNames)
+	names = append(names, attrNames...)
+
+	tags, err := getFileTags(entry.ID)
+	if err != nil {
+		return 0, syscall.EIO
+	}
+
+	for _, t := range tags {
+		names = append(names, tagXattrPrefix+t)
+	}
+
+	var list []byte
+	for _, name := range names {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+
+	return copyXattrValue(list, dest)
+}
+
+// Setxattr creates or updates a Materials Commons attribute (user.mc.attr.<name>), or adds a tag
+// (user.mc.tag.<tag>), on the entry. All other user.mc attributes are read only, and attributes
+// outside of user.mc aren't supported. This overrides the BridgeNode version, which would set
+// them on the underlying storage.
+func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	name, isTag, errno := writableXattrName(attr)
+	if errno != fs.OK {
+		return errno
+	}
+
+	entry, err := n.getMCEntry()
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	err = withTxRetry(func(tx *gorm.DB) error {
+		if isTag {
+			return addFileTag(tx, entry.ID, name)
+		}
+
+		return setFileAttribute(tx, entry.ID, name, string(data), flags&unix.XATTR_CREATE != 0, flags&unix.XATTR_REPLACE != 0)
+	}, db, txRetryCount)
+
+	return xattrUpdateErrno(attr, err)
+}
+
+// Removexattr deletes a Materials Commons attribute, or removes a tag, from the entry.
+func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	name, isTag, errno := writableXattrName(attr)
+	if errno != fs.OK {
+		return errno
+	}
+
+	entry, err := n.getMCEntry()
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	err = withTxRetry(func(tx *gorm.DB) error {
+		if isTag {
+			return removeFileTag(tx, entry.ID, name)
+		}
+
+		return deleteFileAttribute(tx, entry.ID, name)
+	}, db, txRetryCount)
+
+	return xattrUpdateErrno(attr, err)
+}
+
+// writableXattrName returns the attribute or tag name for a writable extended attribute.
+func writableXattrName(attr string) (name string, isTag bool, errno syscall.Errno) {
+	switch {
+	case strings.HasPrefix(attr, attrXattrPrefix) && len(attr) > len(attrXattrPrefix):
+		return strings.TrimPrefix(attr, attrXattrPrefix), false, fs.OK
+	case strings.HasPrefix(attr, tagXattrPrefix) && len(attr) > len(tagXattrPrefix):
+		return strings.TrimPrefix(attr, tagXattrPrefix), true, fs.OK
+	case strings.HasPrefix(attr, mcXattrPrefix):
+		return "", false, syscall.EPERM
+	default:
+		return "", false, syscall.ENOTSUP
+	}
+}
+
+// xattrUpdateErrno maps the error from updating an attribute or tag to an errno.
+func xattrUpdateErrno(attr string, err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return fs.OK
+	case errors.Is(err, errAttributeExists):
+		return syscall.EEXIST
+	case errors.Is(err, errAttributeNotFound):
+		return syscall.ENODATA
+	default:
+		log.Errorf("Failed updating extended attribute %s: %s", attr, err)
+		return syscall.EIO
+	}
+}
+
+// getMCEntry looks up the current Materials Commons file or directory for the node.
+func (n *Node) getMCEntry() (*mcmodel.File, error) {
+	if n.IsDir() {
+		return n.getMCDir("")
+	}
+
+	return getFileEntry(filepath.Join("/", n.Path(n.Root())))
+}
+
+// getFileEntry looks up the file at path. Files that this bridge is writing to return the version
+// being written, as like Getattr, that version isn't in the database as the current version until
+// it's released.
+func getFileEntry(path string) (*mcmodel.File, error) {
+	if inProgress := getFromOpenedFiles(path); inProgress != nil {
+		return inProgress, nil
+	}
+
+	return getEntryByPath(path)
+}
+
+// getVersionCountXattr returns the number of versions of a file. Directories don't have versions
+// so they always have a count of 1.
+func getVersionCountXattr(f *mcmodel.File) (string, error) {
+	if f.IsDir() {
+		return "1", nil
+	}
+
+	var count int64
+	err := db.Model(&mcmodel.File{}).
+		Where("directory_id = ?", f.DirectoryID).
+		Where("name = ?", f.Name).
+		Where("mime_type <> ?", "directory").
+		Where("deleted_at IS NULL").
+		Count(&count).Error
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(count, 10), nil
+}
+
+// getDigest returns the digest of file for algorithm. The stored checksum is used when it's for
+// algorithm, otherwise the digests for the policy algorithms are taken from the cache, computing
+// them from the underlying file when they aren't cached. ok is false when the digest isn't
+// available, which is the case for files that haven't been released yet and for algorithms the
+// policy doesn't compute.
+func getDigest(file *mcmodel.File, algorithm string) (digest string, ok bool) {
+	if storedAlgorithm, digest := parseChecksum(file.Checksum); storedAlgorithm == algorithm && digest != "" {
+		return digest, true
+	}
+
+	if digests, found := checksumDigests.Get(file.ID); found {
+		digest, ok = digests[algorithm]
+		return digest, ok
+	}
+
+	if file.Checksum == "" || !isPolicyChecksumAlgorithm(algorithm) {
+		return "", false
+	}
+
+	digests, err := checksumFile(file.ToUnderlyingFilePath(mcfsRoot), policy.checksumAlgorithms)
+	if err != nil {
+		log.Errorf("Failed computing checksums for %s: %s", file.FullPath(), err)
+		return "", false
+	}
+
+	checksumDigests.Store(file.ID, digests)
+	return digests[algorithm], true
+}
+
+// digestAlgorithms returns the algorithms getDigest can return a digest of file for.
+func digestAlgorithms(file *mcmodel.File) []string {
+	if file.IsDir() || file.Checksum == "" {
+		return nil
+	}
+
+	algorithms := append([]string{}, policy.checksumAlgorithms...)
+	if storedAlgorithm, _ := parseChecksum(file.Checksum); !isPolicyChecksumAlgorithm(storedAlgorithm) {
+		algorithms = append(algorithms, storedAlgorithm)
+	}
+
+	return algorithms
+}
+
+func isPolicyChecksumAlgorithm(algorithm string) bool {
+	for _, a := range policy.checksumAlgorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyXattrValue copies an extended attribute value into dest. When dest is empty the caller is
+// asking for the size of the value.
+func copyXattrValue(value []byte, dest []byte) (uint32, syscall.Errno) {
+	switch {
+	case len(dest) == 0:
+		return uint32(len(value)), fs.OK
+	case len(dest) < len(value):
+		return uint32(len(value)), syscall.ERANGE
+	default:
+		return uint32(copy(dest, value)), fs.OK
+	}
+}
@@ -0,0 +1,36 @@
+package mcbridgefs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/materials-commons/gomcdb/mcmodel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetFileEntryReturnsVersionBeingWritten(t *testing.T) {
+	defer func(tracker *OpenFilesTracker, cache *PathCache) {
+		openedFilesTracker, pathCache = tracker, cache
+	}(openedFilesTracker, pathCache)
+
+	openedFilesTracker = NewOpenFilesTracker()
+	pathCache = NewPathCache(100, time.Hour)
+
+	// A file created in this transfer isn't in the database until it's released
+	pathCache.Store("/data/new.txt", nil)
+	_, err := getFileEntry("/data/new.txt")
+	require.Error(t, err)
+
+	created := &mcmodel.File{ID: 2, Name: "new.txt"}
+	openedFilesTracker.Store("/data/new.txt", created)
+	entry, err := getFileEntry("/data/new.txt")
+	require.NoError(t, err)
+	require.Equal(t, created.ID, entry.ID)
+
+	// Files that aren't being written return the current version
+	current := &mcmodel.File{ID: 3, Name: "old.txt", Current: true}
+	pathCache.Store("/data/old.txt", current)
+	entry, err = getFileEntry("/data/old.txt")
+	require.NoError(t, err)
+	require.Equal(t, current.ID, entry.ID)
+}